@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	smsReplyPath  = "/twilio/sms"
+	smsStatusPath = "/twilio/sms/status"
+
+	// reminderCheckInterval is how often we look for demands that need a reminder
+	reminderCheckInterval = time.Minute
+	reminderTimeout       = 10 * time.Second
+
+	ackUsage = "Reply ack, done or no followed by the demand number, e.g. ack 42"
+)
+
+// ackPattern matches replies like "ack 42", "Done #D42" or a bare "no" which applies to the most
+// recent open demand. The keyword has to be the whole reply so a "no idea" or "done with work" sent
+// in conversation does not close anything.
+var ackPattern = regexp.MustCompile(`(?i)^\s*(ack|done|no)\s*(?:#?d?(\d+))?\s*[.!]?\s*$`)
+
+// ackAttemptPattern matches replies that start with an ack keyword, those that are not valid acks
+// get the usage as an answer while any other message is left unanswered
+var ackAttemptPattern = regexp.MustCompile(`(?i)^\s*(ack|done|no)\b`)
+
+// parseAck extracts the action and demand ID from an SMS reply. The ID is zero when the reply did
+// not include one.
+func parseAck(body string) (string, int, bool) {
+	match := ackPattern.FindStringSubmatch(body)
+	if match == nil {
+		return "", 0, false
+	}
+	var id int
+	if match[2] != "" {
+		var err error
+		id, err = strconv.Atoi(match[2])
+		if err != nil {
+			return "", 0, false
+		}
+	}
+	return strings.ToLower(match[1]), id, true
+}
+
+// latestOpenDemand returns the most recently sent demand that is still open
+func (e *Engine) latestOpenDemand() (DemandRecord, bool) {
+	records := e.store.List()
+	for index := len(records) - 1; index >= 0; index-- {
+		if records[index].Open() {
+			return records[index], true
+		}
+	}
+	return DemandRecord{}, false
+}
+
+// writeMessageTwiML responds to an inbound SMS webhook with a single reply SMS
+func writeMessageTwiML(resp http.ResponseWriter, text string) {
+	var buf bytes.Buffer
+	buf.WriteString("<Response><Message>")
+	xml.EscapeText(&buf, []byte(text))
+	buf.WriteString("</Message></Response>")
+	writeTwiML(resp, buf.String())
+}
+
+// HandleInboundSMS processes replies from the Dan that acknowledge, complete or decline a demand
+// and reports them on the originating slack message.
+func (e *Engine) HandleInboundSMS(resp http.ResponseWriter, req *http.Request) {
+	ctx, ok := e.verifyTwilioRequest(req)
+	if !ok {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// The Dan may answer over SMS when their channel fell back to it
+	from := req.PostForm.Get("From")
+	if parseTwilioAddress(from).Number != parseTwilioAddress(e.currentConfig().Twilio.ToNumber).Number {
+		loggerFrom(ctx).WithField("from", from).Warning("ignoring SMS from unknown number")
+		writeTwiML(resp, "<Response/>")
+		return
+	}
+	// The session window has to survive restarts, or demands go out as templates until the Dan
+	// writes again
+	now := time.Now()
+	e.twilioClient.NoteInbound(from, now)
+	e.store.NoteInbound(from, now)
+
+	body := req.PostForm.Get("Body")
+	action, id, ok := parseAck(body)
+	if !ok {
+		// The Dan also talks to people over this number, or writes only to open a WhatsApp session
+		if ackAttemptPattern.MatchString(body) {
+			writeMessageTwiML(resp, ackUsage)
+		} else {
+			writeTwiML(resp, "<Response/>")
+		}
+		return
+	}
+	var rec DemandRecord
+	if id == 0 {
+		rec, ok = e.latestOpenDemand()
+	} else {
+		rec, ok = e.store.Lookup(id)
+	}
+	// Demands that failed or were withdrawn never reached the Dan, and closed ones stay closed
+	if !ok || !rec.Open() {
+		writeMessageTwiML(resp, "Unknown demand. "+ackUsage)
+		return
+	}
+
+	var emoji, text, confirmation string
+	e.store.Update(rec.Key(), func(r *DemandRecord) {
+		if r.AcknowledgedAt.IsZero() {
+			r.AcknowledgedAt = time.Now()
+		}
+		switch action {
+		case "done":
+			r.Resolution = ResolutionDone
+		case "no":
+			r.Resolution = ResolutionDeclined
+		}
+	})
+	switch action {
+	case "ack":
+		emoji, text, confirmation = "eyes", "The Dan acknowledged this demand.", "Acknowledged "
+	case "done":
+		emoji, text, confirmation = "white_check_mark", "The Dan marked this demand as done.", "Completed "
+	case "no":
+		emoji, text, confirmation = "no_entry_sign", "The Dan declined this demand.", "Declined "
+	}
+	e.slackWrapper.AddReactionBackground(ctx, emoji, rec.Channel, rec.TimeStamp)
+	e.slackWrapper.PostThreadReplyBackground(ctx, rec.Channel, rec.TimeStamp, text)
+	writeMessageTwiML(resp, confirmation+rec.RefCode())
+}
+
+// HandleMessageStatus receives the delivery updates of the messages of a demand and reports the
+// demand as failed in slack when one of them did not reach the Dan
+func (e *Engine) HandleMessageStatus(resp http.ResponseWriter, req *http.Request) {
+	ctx, ok := e.verifyTwilioRequest(req)
+	if !ok {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+
+	status := req.PostForm.Get("MessageStatus")
+	if status != "failed" && status != "undelivered" {
+		return
+	}
+	twErr := newDeliveryError(status, req.PostForm.Get("ErrorCode"))
+	// Every chunk of a demand reports on its own, only the first failure is reported
+	var rec DemandRecord
+	var first bool
+	found := e.store.Update(req.URL.Query().Get("demand"), func(r *DemandRecord) {
+		first = r.Status == DemandSent || r.Status == DemandQueued
+		if first {
+			r.Status = DemandFailed
+		}
+		rec = *r
+	})
+	if !found || !first {
+		return
+	}
+	loggerFrom(ctx).WithError(twErr).WithField("demand", rec.RefCode()).Error("demand was not delivered")
+	recordDemand(ctx, "undelivered", "twilio_"+string(twErr.Class()))
+	e.slackWrapper.AddReactionBackground(ctx, "thumbsdown", rec.Channel, rec.TimeStamp)
+	e.slackWrapper.PostThreadReplyBackground(ctx, rec.Channel, rec.TimeStamp, "Couldn't text the Dan: "+twErr.Reason()+".")
+}
+
+// reminderLoop periodically texts the Dan about open demands that have not been acknowledged
+// within the configured time. Each demand is only reminded about once.
+func (e *Engine) reminderLoop() {
+	ticker := time.NewTicker(reminderCheckInterval)
+	for range ticker.C {
+		loopHeartbeats.Beat("reminder", reminderCheckInterval)
+		after := e.currentSettings().remindAfter
+		if after == 0 {
+			continue
+		}
+		for _, rec := range e.store.List() {
+			if !rec.Open() || rec.Reminded || !rec.AcknowledgedAt.IsZero() || time.Since(rec.SentAt) < after {
+				continue
+			}
+			e.store.Update(rec.Key(), func(r *DemandRecord) {
+				r.Reminded = true
+			})
+
+			reminder := "Reminder " + rec.RefCode() + " from " + rec.Sender + ": " +
+				truncate(condense(e.slackWrapper.ReplaceUIDs(rec.Text)), disregardPreviewLength) +
+				" (reply ack " + strconv.Itoa(rec.ID) + ")"
+			ctx, cancel := context.WithTimeout(context.Background(), reminderTimeout)
+			ctx = withLogFields(ctx, logrus.Fields{"demand": rec.RefCode()})
+			if _, err := e.sendChunks(ctx, reminder, nil, ""); err != nil {
+				loggerFrom(ctx).WithError(err).Error("failed to send reminder")
+			}
+			cancel()
+		}
+	}
+}
+
+// HandleOpenDemands lists every demand that has not been closed by the Dan as JSON
+func (e *Engine) HandleOpenDemands(resp http.ResponseWriter, req *http.Request) {
+	open := []DemandRecord{}
+	for _, rec := range e.store.List() {
+		if rec.Open() {
+			open = append(open, rec)
+		}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(resp)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(open); err != nil {
+		logger.WithError(err).Error("failed to encode open demands")
+	}
+}
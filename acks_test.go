@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestParseAck(t *testing.T) {
+	cases := []struct {
+		body   string
+		action string
+		id     int
+		ok     bool
+	}{
+		{"ack 42", "ack", 42, true},
+		{"Done #D42", "done", 42, true},
+		{"ack #42", "ack", 42, true},
+		{"no", "no", 0, true},
+		{" Done! ", "done", 0, true},
+		{"no idea who that is", "", 0, false},
+		{"done with work, heading home", "", 0, false},
+		{"ack 42 but later", "", 0, false},
+		{"ackd", "", 0, false},
+	}
+	for _, c := range cases {
+		action, id, ok := parseAck(c.body)
+		if action != c.action || id != c.id || ok != c.ok {
+			t.Errorf("parseAck(%q) = %q, %d, %v, expected %q, %d, %v", c.body, action, id, ok, c.action, c.id, c.ok)
+		}
+	}
+}
+
+func TestAckAttempt(t *testing.T) {
+	cases := map[string]bool{
+		"ack 4x":              true,
+		"Done with #D42":      true,
+		"no idea who that is": true,
+		"hi":                  false,
+		"nothing yet":         false,
+		"running late, sorry": false,
+		"":                    false,
+	}
+	for body, want := range cases {
+		if got := ackAttemptPattern.MatchString(body); got != want {
+			t.Errorf("ackAttemptPattern.MatchString(%q) = %v, expected %v", body, got, want)
+		}
+	}
+}
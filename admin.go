@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+const (
+	// minAdminTokenLength keeps the admin token from being trivially guessable
+	minAdminTokenLength = 16
+	// adminRecentDemands is how many of the most recent demands the console shows
+	adminRecentDemands = 50
+	// adminActionTimeout bounds retries and test messages sent from the console
+	adminActionTimeout = time.Minute
+
+	testSMSMessage = "DanDemand test message, no action needed"
+)
+
+// adminStatus is everything the admin console shows
+type adminStatus struct {
+	Demands     []DemandRecord         `json:"demands"`
+	DeadLetters []DemandRecord         `json:"dead_letters"`
+	Limiter     limiterStatus          `json:"limiter"`
+	Senders     []senderQuota          `json:"senders"`
+	UserCache   userCacheStatus        `json:"user_cache"`
+	Config      map[string]interface{} `json:"config"`
+}
+
+type limiterStatus struct {
+	Interval  string `json:"interval"`
+	InFlight  int64  `json:"in_flight"`
+	Recipient string `json:"recipient"`
+}
+
+// senderQuota is how much of the Dan's attention a single slack user has used recently
+type senderQuota struct {
+	Sender string    `json:"sender"`
+	Total  int       `json:"total"`
+	Sent   int       `json:"sent"`
+	Failed int       `json:"failed"`
+	Open   int       `json:"open"`
+	Last   time.Time `json:"last"`
+}
+
+type userCacheStatus struct {
+	LastRefresh time.Time         `json:"last_refresh"`
+	Users       map[string]string `json:"users"`
+}
+
+// adminStatus collects the current state of the engine for the admin console
+func (e *Engine) adminStatus() adminStatus {
+	records := e.store.List()
+	status := adminStatus{
+		Demands:     []DemandRecord{},
+		DeadLetters: []DemandRecord{},
+		Limiter: limiterStatus{
+			Interval:  e.twilioClient.Limit().String(),
+			InFlight:  atomic.LoadInt64(&e.queued),
+			Recipient: e.twilioClient.Recipient(),
+		},
+		Senders: []senderQuota{},
+		UserCache: userCacheStatus{
+			LastRefresh: e.slackWrapper.LastRefresh(),
+			Users:       e.slackWrapper.Users(),
+		},
+		Config: e.currentConfig().Redacted(),
+	}
+
+	senders := make(map[string]*senderQuota)
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := records[i]
+		if len(status.Demands) < adminRecentDemands {
+			status.Demands = append(status.Demands, rec)
+		}
+		if rec.Status == DemandFailed {
+			status.DeadLetters = append(status.DeadLetters, rec)
+		}
+
+		quota, ok := senders[rec.Sender]
+		if !ok {
+			quota = &senderQuota{Sender: rec.Sender, Last: rec.CreatedAt}
+			senders[rec.Sender] = quota
+		}
+		quota.Total++
+		switch rec.Status {
+		case DemandSent:
+			quota.Sent++
+		case DemandFailed:
+			quota.Failed++
+		}
+		if rec.Open() {
+			quota.Open++
+		}
+	}
+	for _, quota := range senders {
+		status.Senders = append(status.Senders, *quota)
+	}
+	sort.Slice(status.Senders, func(i, j int) bool {
+		if status.Senders[i].Total != status.Senders[j].Total {
+			return status.Senders[i].Total > status.Senders[j].Total
+		}
+		return status.Senders[i].Sender < status.Senders[j].Sender
+	})
+	return status
+}
+
+// RetryDemand sends a dead-lettered demand again. Attachments and thread context are not kept in
+// the DemandStore so only the text of the demand is resent.
+func (e *Engine) RetryDemand(ctx context.Context, id int) error {
+	rec, ok := e.store.Lookup(id)
+	if !ok {
+		return errors.Errorf("unknown demand %s", refCode(id))
+	}
+	key := rec.Key()
+
+	ctx, span := trace.StartSpan(ctx, "dan_demand.RetryDemand")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("demand.key", key))
+	ctx = withDemandTags(ctx, channelTypeFromID(rec.Channel), e.twilioClient.Recipient())
+	ctx = withLogFields(ctx, logrus.Fields{"demand": refCode(id)})
+	defer e.enqueue()()
+
+	sendCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var claimed bool
+	e.store.Update(key, func(rec *DemandRecord) {
+		if rec.Status == DemandFailed {
+			rec.Status = DemandQueued
+			rec.cancel = cancel
+			claimed = true
+		}
+	})
+	if !claimed {
+		return errors.Errorf("demand %s is no longer failed", refCode(id))
+	}
+	// Keep slack retries of the original event from sending it a second time
+	e.deduper.Seen(key)
+
+	loggerFrom(ctx).Info("retrying demand from the admin console")
+	return e.relayDemand(ctx, sendCtx, &Demand{
+		Channel:     rec.Channel,
+		ChannelType: channelTypeFromID(rec.Channel),
+		TimeStamp:   rec.TimeStamp,
+		Sender:      rec.Sender,
+		Text:        rec.Text,
+		ID:          rec.ID,
+	})
+}
+
+// DiscardDemand gives up on a dead-lettered demand
+func (e *Engine) DiscardDemand(id int) error {
+	rec, ok := e.store.Lookup(id)
+	if !ok {
+		return errors.Errorf("unknown demand %s", refCode(id))
+	}
+	var discarded bool
+	e.store.Update(rec.Key(), func(rec *DemandRecord) {
+		if rec.Status == DemandFailed {
+			rec.Status = DemandDiscarded
+			discarded = true
+		}
+	})
+	if !discarded {
+		return errors.Errorf("demand %s is no longer failed", refCode(id))
+	}
+	logger.WithField("demand", refCode(id)).Info("discarded demand from the admin console")
+	return nil
+}
+
+// requireAdmin only lets requests carrying the admin token through, either as a bearer token or
+// as the basic auth password so the console works from a browser.
+func (e *Engine) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		token := e.currentConfig().Server.AdminToken
+		if token == "" {
+			http.Error(resp, "admin console is disabled, set server.admin_token to enable it", http.StatusNotFound)
+			return
+		}
+
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := req.BasicAuth(); ok {
+			given = password
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			resp.Header().Set("WWW-Authenticate", `Basic realm="dan-demand admin"`)
+			http.Error(resp, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Browsers send credentials along with cross site form posts, so refuse those
+		if req.Method == "POST" {
+			if origin := req.Header.Get("Origin"); origin != "" {
+				parsed, err := url.Parse(origin)
+				if err != nil || parsed.Host != req.Host {
+					http.Error(resp, "cross origin request refused", http.StatusForbidden)
+					return
+				}
+			}
+		}
+		handler(resp, req)
+	}
+}
+
+// writeAdminResult reports the outcome of an admin action, browsers are sent back to the console
+// and API clients get JSON.
+func writeAdminResult(resp http.ResponseWriter, req *http.Request, err error) {
+	if strings.Contains(req.Header.Get("Accept"), "text/html") {
+		target := "/admin/"
+		if err != nil {
+			target += "?error=" + url.QueryEscape(err.Error())
+		}
+		http.Redirect(resp, req, target, http.StatusSeeOther)
+		return
+	}
+
+	result := struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	}{OK: err == nil}
+	resp.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		result.Error = err.Error()
+		resp.WriteHeader(http.StatusBadRequest)
+	}
+	if encodeErr := json.NewEncoder(resp).Encode(result); encodeErr != nil {
+		logger.WithError(encodeErr).Error("failed to encode admin result")
+	}
+}
+
+// demandIDFromForm parses the demand ID from an admin form, accepting either "42" or "#D42"
+func demandIDFromForm(req *http.Request) (int, error) {
+	raw := strings.TrimPrefix(strings.TrimSpace(req.FormValue("id")), "#D")
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, errors.Errorf("invalid demand id %q", req.FormValue("id"))
+	}
+	return id, nil
+}
+
+// HandleAdminStatus returns the admin console data as JSON
+func (e *Engine) HandleAdminStatus(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(resp)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(e.adminStatus()); err != nil {
+		logger.WithError(err).Error("failed to encode admin status")
+	}
+}
+
+// HandleAdminRetry resends the dead-lettered demand given by the id form value
+func (e *Engine) HandleAdminRetry(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := demandIDFromForm(req)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), adminActionTimeout)
+		defer cancel()
+		err = e.RetryDemand(ctx, id)
+	}
+	writeAdminResult(resp, req, err)
+}
+
+// HandleAdminDiscard drops the dead-lettered demand given by the id form value
+func (e *Engine) HandleAdminDiscard(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := demandIDFromForm(req)
+	if err == nil {
+		err = e.DiscardDemand(id)
+	}
+	writeAdminResult(resp, req, err)
+}
+
+// HandleAdminTestSMS texts the Dan a test message, optionally with custom text
+func (e *Engine) HandleAdminTestSMS(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	message := strings.TrimSpace(req.FormValue("message"))
+	if message == "" {
+		message = testSMSMessage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), adminActionTimeout)
+	defer cancel()
+	_, err := e.twilioClient.SendMessage(ctx, SendMessageParams{Message: message})
+	if err != nil {
+		err = errors.Wrap(err, "failed to send test SMS: ")
+		logger.WithError(err).Error("admin test SMS failed")
+	} else {
+		logger.Info("sent test SMS from the admin console")
+	}
+	writeAdminResult(resp, req, err)
+}
+
+// HandleAdminConsole renders the admin console as HTML
+func (e *Engine) HandleAdminConsole(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/admin/" {
+		http.NotFound(resp, req)
+		return
+	}
+	data := struct {
+		adminStatus
+		Error       string
+		TestMessage string
+	}{e.adminStatus(), req.URL.Query().Get("error"), testSMSMessage}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := adminTemplate.Execute(resp, data); err != nil {
+		logger.WithError(err).Error("failed to render admin console")
+	}
+}
+
+var adminTemplate = template.Must(template.New("admin").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Truncate(time.Second).String() + " ago"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>DanDemand admin</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>DanDemand admin</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<p>JSON: <a href="/admin/api/status">/admin/api/status</a></p>
+
+<h2>Twilio</h2>
+<table>
+<tr><th>Rate limit</th><td>1 SMS every {{.Limiter.Interval}}</td></tr>
+<tr><th>In flight</th><td>{{.Limiter.InFlight}}</td></tr>
+<tr><th>Recipient</th><td>{{.Limiter.Recipient}}</td></tr>
+</table>
+<form method="POST" action="/admin/api/test-sms">
+<input name="message" size="60" placeholder="{{.TestMessage}}">
+<button type="submit">Send test SMS</button>
+</form>
+
+<h2>Dead letters</h2>
+{{if .DeadLetters}}
+<table>
+<tr><th>Ref</th><th>Created</th><th>Sender</th><th>Text</th><th></th></tr>
+{{range .DeadLetters}}
+<tr>
+<td>{{.RefCode}}</td><td>{{ago .CreatedAt}}</td><td>{{.Sender}}</td><td>{{.Text}}</td>
+<td>
+<form method="POST" action="/admin/api/demands/retry" style="display:inline"><input type="hidden" name="id" value="{{.ID}}"><button type="submit">Retry</button></form>
+<form method="POST" action="/admin/api/demands/discard" style="display:inline"><input type="hidden" name="id" value="{{.ID}}"><button type="submit">Discard</button></form>
+</td>
+</tr>
+{{end}}
+</table>
+{{else}}<p>None</p>{{end}}
+
+<h2>Recent demands</h2>
+<table>
+<tr><th>Ref</th><th>Created</th><th>Sender</th><th>Status</th><th>Resolution</th><th>Text</th></tr>
+{{range .Demands}}
+<tr><td>{{.RefCode}}</td><td>{{ago .CreatedAt}}</td><td>{{.Sender}}</td><td>{{.Status}}{{if .Escalated}} (called){{end}}</td><td>{{.Resolution}}</td><td>{{.Text}}</td></tr>
+{{end}}
+</table>
+
+<h2>Senders</h2>
+<table>
+<tr><th>Sender</th><th>Total</th><th>Sent</th><th>Failed</th><th>Open</th><th>Last demand</th></tr>
+{{range .Senders}}
+<tr><td>{{.Sender}}</td><td>{{.Total}}</td><td>{{.Sent}}</td><td>{{.Failed}}</td><td>{{.Open}}</td><td>{{ago .Last}}</td></tr>
+{{end}}
+</table>
+
+<h2>User cache</h2>
+<p>{{len .UserCache.Users}} users, last refreshed {{ago .UserCache.LastRefresh}}</p>
+<table>
+<tr><th>UID</th><th>Name</th></tr>
+{{range $uid, $name := .UserCache.Users}}<tr><td>{{$uid}}</td><td>{{$name}}</td></tr>
+{{end}}
+</table>
+
+<h2>Config</h2>
+<table>
+{{range $key, $value := .Config}}<tr><th>{{$key}}</th><td>{{$value}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const mb = 1024 * kb
+
+// capturedHeaders are the request headers worth keeping alongside a captured payload
+var capturedHeaders = []string{
+	"Content-Type",
+	"User-Agent",
+	"X-Slack-Request-Timestamp",
+	"X-Slack-Retry-Num",
+	"X-Slack-Retry-Reason",
+}
+
+// CapturedEvent is a single slack request as written to the capture log
+type CapturedEvent struct {
+	Time    time.Time         `json:"time"`
+	Headers map[string]string `json:"headers"`
+	// Body is the payload as slack sent it apart from redacted tokens and whitespace
+	Body json.RawMessage `json:"body"`
+}
+
+// EventCapture writes every verified slack payload to a log file, rotating it once it grows past
+// maxSize. Up to backups old files are kept as path.1, path.2 and so on, newest first.
+type EventCapture struct {
+	path    string
+	maxSize int64
+	backups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewEventCapture appends to the capture file at path, creating it if needed
+func NewEventCapture(path string, maxSize int64, backups int) (*EventCapture, error) {
+	ec := &EventCapture{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+	if err := ec.open(); err != nil {
+		return nil, err
+	}
+	return ec, nil
+}
+
+// open opens the current capture file for appending. The caller must hold the lock.
+func (ec *EventCapture) open() error {
+	file, err := os.OpenFile(ec.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to open capture file: ")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to stat capture file: ")
+	}
+	ec.file = file
+	ec.size = info.Size()
+	return nil
+}
+
+// rotate shifts every capture file along by one, dropping the oldest, and starts a new one. The
+// caller must hold the lock.
+func (ec *EventCapture) rotate() error {
+	if err := ec.file.Close(); err != nil {
+		return errors.Wrap(err, "failed to close capture file: ")
+	}
+	if ec.backups == 0 {
+		os.Remove(ec.path)
+	}
+	for index := ec.backups; index > 0; index-- {
+		from := ec.path
+		if index > 1 {
+			from = fmt.Sprintf("%s.%d", ec.path, index-1)
+		}
+		err := os.Rename(from, fmt.Sprintf("%s.%d", ec.path, index))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to rotate capture file: ")
+		}
+	}
+	return ec.open()
+}
+
+// payloadTokenPattern matches the verification token field slack includes in every payload
+var payloadTokenPattern = regexp.MustCompile(`"token"\s*:\s*"[^"]*"`)
+
+// redactPayload removes the verification token and any slack tokens from a raw payload while
+// leaving the rest of it byte for byte intact
+func redactPayload(body []byte) []byte {
+	body = payloadTokenPattern.ReplaceAll(body, []byte(`"token":"`+redactedValue+`"`))
+	return slackTokenPattern.ReplaceAll(body, []byte("$1-"+redactedValue))
+}
+
+// Capture records a verified request
+func (ec *EventCapture) Capture(header http.Header, body []byte) error {
+	event := CapturedEvent{
+		Time:    time.Now().UTC(),
+		Headers: make(map[string]string),
+		Body:    redactPayload(body),
+	}
+	for _, name := range capturedHeaders {
+		if val := header.Get(name); val != "" {
+			event.Headers[name] = val
+		}
+	}
+	// Encoder adds the trailing newline, and leaving HTML alone keeps the body readable
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(event); err != nil {
+		return errors.Wrap(err, "failed to marshal captured event: ")
+	}
+
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	if ec.size > 0 && ec.size+int64(line.Len()) > ec.maxSize {
+		if err := ec.rotate(); err != nil {
+			return err
+		}
+	}
+	written, err := ec.file.Write(line.Bytes())
+	ec.size += int64(written)
+	return errors.Wrap(err, "failed to write captured event: ")
+}
+
+// Close closes the current capture file
+func (ec *EventCapture) Close() error {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	return ec.file.Close()
+}
+
+// ReadCapturedEvents reads every event from a capture file, oldest first
+func ReadCapturedEvents(r io.Reader) ([]CapturedEvent, error) {
+	var events []CapturedEvent
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*kb), 16*mb)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var event CapturedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, errors.Wrapf(err, "invalid captured event on line %d: ", line)
+		}
+		events = append(events, event)
+	}
+	return events, errors.Wrap(scanner.Err(), "failed to read captured events: ")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCaptureRedactsTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+	capture, err := NewEventCapture(path, mb, 1)
+	if err != nil {
+		t.Fatalf("failed to create capture: %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Slack-Signature", "v0=abc")
+	header.Set("X-Slack-Request-Timestamp", "1500000000")
+	body := `{"token":"` + testVerificationToken + `","event":{"text":"my token is xoxb-1234-abcd"}}`
+	if err := capture.Capture(header, []byte(body)); err != nil {
+		t.Fatalf("failed to capture event: %v", err)
+	}
+	capture.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{testVerificationToken, "xoxb-1234-abcd", "v0=abc"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("capture file contains %q: %s", secret, data)
+		}
+	}
+	events, err := ReadCapturedEvents(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to read captured events: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	if got := events[0].Headers["X-Slack-Request-Timestamp"]; got != "1500000000" {
+		t.Errorf("expected the request timestamp to be kept, got %q", got)
+	}
+	want := `{"token":"<redacted>","event":{"text":"my token is xoxb-<redacted>"}}`
+	if string(events[0].Body) != want {
+		t.Errorf("expected body %s, got %s", want, events[0].Body)
+	}
+}
+
+func TestCaptureRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+	// Small enough that every event needs a file of its own
+	capture, err := NewEventCapture(path, 64, 2)
+	if err != nil {
+		t.Fatalf("failed to create capture: %v", err)
+	}
+	defer capture.Close()
+
+	for i := 1; i <= 4; i++ {
+		body := fmt.Sprintf(`{"event_id":"Ev%d"}`, i)
+		if err := capture.Capture(http.Header{}, []byte(body)); err != nil {
+			t.Fatalf("failed to capture event %d: %v", i, err)
+		}
+	}
+
+	// The newest event is in path, older ones in path.1 and path.2 and the first was dropped
+	for suffix, want := range map[string]string{"": "Ev4", ".1": "Ev3", ".2": "Ev2"} {
+		file, err := os.Open(path + suffix)
+		if err != nil {
+			t.Fatalf("expected %s to exist: %v", path+suffix, err)
+		}
+		events, err := ReadCapturedEvents(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path+suffix, err)
+		}
+		if len(events) != 1 || !strings.Contains(string(events[0].Body), want) {
+			t.Errorf("expected %s to hold only %s, got %v", path+suffix, want, events)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups to be kept")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Channels a demand can be delivered over. The recipient picks one by prefixing twilio.to_number,
+// e.g. "whatsapp:+15555550100", plain numbers are texted.
+const (
+	channelSMS      = "sms"
+	channelWhatsApp = "whatsapp"
+	channelRCS      = "rcs"
+)
+
+const (
+	// whatsappSessionWindow is how long after the Dan last messaged us WhatsApp lets us send free
+	// form messages, outside of it only approved templates can be sent
+	whatsappSessionWindow = 24 * time.Hour
+	// templateVariableLimit is the longest value WhatsApp accepts for a template variable
+	templateVariableLimit = 1024
+)
+
+// channelBodyLimits is the longest body a single message can have on each channel. WhatsApp and
+// RCS messages are not split into segments, so only SMS is held to twilio's concatenation limit.
+var channelBodyLimits = map[string]int{
+	channelSMS:      twilioMsgLimit,
+	channelWhatsApp: 4096,
+	channelRCS:      3072,
+}
+
+// errNoSession is returned when a WhatsApp message is outside the session window and there is no
+// template to send instead
+var errNoSession = errors.New("outside the WhatsApp session window and no template is configured")
+
+// twilioAddress is a recipient or sender on a channel
+type twilioAddress struct {
+	Channel string
+	// Number is the phone number, or the sender ID of an RCS agent
+	Number string
+}
+
+// parseTwilioAddress splits an address like "whatsapp:+15555550100" into its channel and number,
+// addresses without a known channel prefix are SMS
+func parseTwilioAddress(addr string) twilioAddress {
+	if parts := strings.SplitN(addr, ":", 2); len(parts) == 2 {
+		switch parts[0] {
+		case channelWhatsApp, channelRCS:
+			return twilioAddress{Channel: parts[0], Number: parts[1]}
+		}
+	}
+	return twilioAddress{Channel: channelSMS, Number: addr}
+}
+
+// On returns the address of the same number on another channel
+func (ta twilioAddress) On(channel string) twilioAddress {
+	return twilioAddress{Channel: channel, Number: ta.Number}
+}
+
+// String renders the address the way twilio expects it in To and From
+func (ta twilioAddress) String() string {
+	if ta.Channel == channelSMS || ta.Number == "" {
+		return ta.Number
+	}
+	return ta.Channel + ":" + ta.Number
+}
+
+// templateVariables renders the content variables of a template message, the demand is its only
+// variable
+func templateVariables(message string) (string, error) {
+	vars, err := json.Marshal(map[string]string{"1": message})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal template variables: ")
+	}
+	return string(vars), nil
+}
+
+// NoteInbound records that the recipient messaged us at the given time, which opens their WhatsApp
+// session window
+func (tw *TwilioClient) NoteInbound(from string, at time.Time) {
+	addr := parseTwilioAddress(from)
+	tw.sessionLock.Lock()
+	defer tw.sessionLock.Unlock()
+	if at.After(tw.lastInbound[addr.String()]) {
+		tw.lastInbound[addr.String()] = at
+	}
+}
+
+// inSession reports whether free form messages can be sent to addr
+func (tw *TwilioClient) inSession(addr twilioAddress) bool {
+	if addr.Channel != channelWhatsApp {
+		return true
+	}
+	tw.sessionLock.Lock()
+	defer tw.sessionLock.Unlock()
+	return time.Since(tw.lastInbound[addr.String()]) < whatsappSessionWindow
+}
+
+// DeliveryChannel returns the channel the next demand should be sent over, which falls back to
+// SMS when WhatsApp can send neither a free form message nor a template
+func (tw *TwilioClient) DeliveryChannel() string {
+	tw.numberLock.RLock()
+	to, templateSID := parseTwilioAddress(tw.toNumber), tw.templateSID
+	tw.numberLock.RUnlock()
+	if to.Channel == channelWhatsApp && templateSID == "" && !tw.inSession(to) {
+		return channelSMS
+	}
+	return to.Channel
+}
+
+// BodyLimit returns the longest message that can be sent in one piece over channel
+func (tw *TwilioClient) BodyLimit(channel string) int {
+	if channel == channelWhatsApp && !tw.inSession(parseTwilioAddress(tw.Recipient())) {
+		return templateVariableLimit
+	}
+	return channelBodyLimits[channel]
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/pelletier/go-toml"
 	"github.com/pkg/errors"
@@ -12,88 +17,492 @@ const (
 	defaultServerAddress = "127.0.0.1:8080"
 	defaultZPagesAddress = "127.0.0.1:8081"
 	defaultTwilioLimit   = "1s"
+	defaultTwilioBaseURL = "https://api.twilio.com/2010-04-01"
+	defaultHandlerMode   = handlerModeSequential
+	defaultSlackAPIURL   = "https://slack.com/api/"
+	defaultUserFormat    = userFormatHandle
+
+	defaultThreadReplies  = 3
+	defaultThreadSegments = 3
+	defaultEditWindow     = "15m"
+
+	defaultEscalationKeyword = "!call"
+
+	defaultLogFormat = logFormatLogfmt
+	defaultLogLevel  = "info"
+
+	defaultEmailAfterChunks = 3
+
+	defaultCaptureMaxSizeMB = 10
+	defaultCaptureBackups   = 3
+
+	defaultTraceExporter       = traceExporterZPages
+	defaultTraceSampleFraction = 1e-4
+
+	// secretFileSuffix marks settings that name a file holding the value of their sibling setting,
+	// e.g. token_file for token
+	secretFileSuffix = "_file"
 )
 
+// Every setting can come from the config file using its toml name, from the environment using its
+// env name, or from a -dan-demand.set flag using "section.toml_name=value".
+
 type ServerConfig struct {
-	Address       string `toml:"address"`
-	ZPagesAddress string `toml:"zpages_address"`
+	Address       string `toml:"address" env:"SERVER_ADDR"`
+	ZPagesAddress string `toml:"zpages_address" env:"ZPAGES_ADDR"`
+	// PublicURL is the externally reachable base URL of Address, twilio webhooks are only enabled
+	// when it is set
+	PublicURL string `toml:"public_url" env:"SERVER_PUBLIC_URL"`
+	// AdminToken protects the admin console on the zpages server, the console is disabled when it
+	// is empty
+	AdminToken     string `toml:"admin_token" env:"SERVER_ADMIN_TOKEN"`
+	AdminTokenFile string `toml:"admin_token_file" env:"SERVER_ADMIN_TOKEN_FILE"`
 }
 
-func (sec *ServerConfig) InitFromEnv() {
-	sec.Address = os.Getenv("SERVER_ADDR")
-	sec.ZPagesAddress = os.Getenv("ZPAGES_ADDR")
+type SlackConfig struct {
+	BotToken              string `toml:"bot_token" env:"SLACK_BOT_TOKEN"`
+	BotTokenFile          string `toml:"bot_token_file" env:"SLACK_BOT_TOKEN_FILE"`
+	AppToken              string `toml:"app_token" env:"SLACK_APP_TOKEN"`
+	AppTokenFile          string `toml:"app_token_file" env:"SLACK_APP_TOKEN_FILE"`
+	VerificationToken     string `toml:"verification_token" env:"SLACK_VERIF_TOKEN"`
+	VerificationTokenFile string `toml:"verification_token_file" env:"SLACK_VERIF_TOKEN_FILE"`
+	RefreshInterval       string `toml:"refresh_interval" env:"SLACK_REFRESH_INTERVAL"`
+	HandlerMode           string `toml:"handler_mode" env:"SLACK_HANDLER_MODE"`
+	ReactionEmoji         string `toml:"reaction_emoji" env:"SLACK_REACTION_EMOJI"`
+
+	// UserFormat is how users are named in SMS, see DirectoryEntry.Format
+	UserFormat string `toml:"user_format" env:"SLACK_USER_FORMAT"`
+
+	// SigningSecret is used to verify the signature of every event when set
+	SigningSecret     string `toml:"signing_secret" env:"SLACK_SIGNING_SECRET"`
+	SigningSecretFile string `toml:"signing_secret_file" env:"SLACK_SIGNING_SECRET_FILE"`
+	// APIURL is the root of the slack Web API, it only needs changing for tests
+	APIURL string `toml:"api_url" env:"SLACK_API_URL"`
+	// UserCacheFile is where the user directory is snapshotted so names resolve right after a
+	// restart, it is not persisted when empty
+	UserCacheFile string `toml:"user_cache_file" env:"SLACK_USER_CACHE_FILE"`
 }
 
-type SlackConfig struct {
-	BotToken          string `toml:"bot_token"`
-	AppToken          string `toml:"app_token"`
-	VerificationToken string `toml:"verification_token"`
-	RefreshInterval   string `toml:"refresh_interval"`
+type TwilioConfig struct {
+	SID        string `toml:"account_sid" env:"TWILIO_SID"`
+	Token      string `toml:"token" env:"TWILIO_TOKEN"`
+	TokenFile  string `toml:"token_file" env:"TWILIO_TOKEN_FILE"`
+	ToNumber   string `toml:"to_number" env:"TWILIO_TO_NUMBER"`
+	FromNumber string `toml:"from_number" env:"TWILIO_FROM_NUMBER"`
+	// FromNumbers is a pool of numbers SMS are sent from instead of FromNumber, each of them is
+	// rate limited on its own
+	FromNumbers []string `toml:"from_numbers" env:"TWILIO_FROM_NUMBERS"`
+	// MessagingServiceSID sends SMS through a messaging service, which picks the sender itself
+	MessagingServiceSID string `toml:"messaging_service_sid" env:"TWILIO_MESSAGING_SERVICE_SID"`
+	// WhatsAppFrom and RCSFrom are the senders used when ToNumber is a whatsapp: or rcs: address,
+	// the messaging service picks one when they are empty
+	WhatsAppFrom string `toml:"whatsapp_from" env:"TWILIO_WHATSAPP_FROM"`
+	RCSFrom      string `toml:"rcs_from" env:"TWILIO_RCS_FROM"`
+	// WhatsAppTemplateSID is the approved content template sent outside the 24 hour session window,
+	// its {{1}} variable is filled with the demand. Demands fall back to SMS without one.
+	WhatsAppTemplateSID string `toml:"whatsapp_template_sid" env:"TWILIO_WHATSAPP_TEMPLATE_SID"`
+	// Limit is the minimum interval between SMS sent from a single number or messaging service
+	Limit string `toml:"rate_limit" env:"TWILIO_LIMIT"`
+	// BaseURL is the root of the versioned twilio REST API, it only needs changing for tests
+	BaseURL string `toml:"base_url" env:"TWILIO_BASE_URL"`
 }
 
-func (slc *SlackConfig) InitFromEnv() {
-	slc.BotToken = os.Getenv("SLACK_BOT_TOKEN")
-	slc.AppToken = os.Getenv("SLACK_APP_TOKEN")
-	slc.VerificationToken = os.Getenv("SLACK_VERIF_TOKEN")
-	slc.RefreshInterval = os.Getenv("SLACK_REFRESH_INTERVAL")
+// DemandConfig controls how slack messages are turned into demands
+type DemandConfig struct {
+	ThreadContext  bool `toml:"thread_context" env:"DEMAND_THREAD_CONTEXT"`
+	ThreadReplies  int  `toml:"thread_replies" env:"DEMAND_THREAD_REPLIES"`
+	ThreadSegments int  `toml:"thread_segments" env:"DEMAND_THREAD_SEGMENTS"`
+
+	EditWindow       string `toml:"edit_window" env:"DEMAND_EDIT_WINDOW"`
+	DisregardDeleted bool   `toml:"disregard_deleted" env:"DEMAND_DISREGARD_DELETED"`
+	StateFile        string `toml:"state_file" env:"DEMAND_STATE_FILE"`
+
+	RemindAfter string `toml:"remind_after" env:"DEMAND_REMIND_AFTER"`
 }
 
-type TwilioConfig struct {
-	SID        string `toml:"account_sid"`
-	Token      string `toml:"token"`
-	ToNumber   string `toml:"to_number"`
-	FromNumber string `toml:"from_number"`
-	Limit      string `toml:"rate_limit"`
+// EscalationConfig controls escalating demands to voice calls. Escalation is only enabled when
+// the server has a public_url since twilio needs it to report the outcome of a call.
+type EscalationConfig struct {
+	Keyword string `toml:"keyword" env:"ESCALATION_KEYWORD"`
+	After   string `toml:"after" env:"ESCALATION_AFTER"`
+	Voice   string `toml:"voice" env:"ESCALATION_VOICE"`
+}
+
+// EmailConfig controls emailing demands that are too long to read comfortably as texts
+type EmailConfig struct {
+	// SMTPAddress is the host:port of the SMTP server, email is disabled when it is empty
+	SMTPAddress  string `toml:"smtp_address" env:"EMAIL_SMTP_ADDR"`
+	Username     string `toml:"username" env:"EMAIL_USERNAME"`
+	Password     string `toml:"password" env:"EMAIL_PASSWORD"`
+	PasswordFile string `toml:"password_file" env:"EMAIL_PASSWORD_FILE"`
+	From         string `toml:"from" env:"EMAIL_FROM"`
+	// To is the Dan's email address
+	To string `toml:"to" env:"EMAIL_TO"`
+	// Always emails every demand instead of texting it
+	Always bool `toml:"always" env:"EMAIL_ALWAYS"`
+	// AfterChunks emails demands that would take more than this many texts, 0 disables it
+	AfterChunks int `toml:"after_chunks" env:"EMAIL_AFTER_CHUNKS"`
+}
+
+// LoggingConfig controls the structured logger
+type LoggingConfig struct {
+	// Format is either logfmt or json
+	Format string `toml:"format" env:"LOG_FORMAT"`
+	// Level is one of debug, info, warning or error
+	Level string `toml:"level" env:"LOG_LEVEL"`
+}
+
+// CaptureConfig controls recording verified slack events to disk so they can be replayed later
+type CaptureConfig struct {
+	// File is where events are written, capturing is disabled when it is empty
+	File      string `toml:"file" env:"CAPTURE_FILE"`
+	MaxSizeMB int    `toml:"max_size_mb" env:"CAPTURE_MAX_SIZE_MB"`
+	// Backups is how many rotated files are kept next to File
+	Backups int `toml:"backups" env:"CAPTURE_BACKUPS"`
 }
 
-func (tc *TwilioConfig) InitFromEnv() {
-	tc.SID = os.Getenv("TWILIO_SID")
-	tc.Token = os.Getenv("TWILIO_TOKEN")
-	tc.ToNumber = os.Getenv("TWILIO_TO_NUMBER")
-	tc.FromNumber = os.Getenv("TWILIO_FROM_NUMBER")
-	tc.Limit = os.Getenv("TWILIO_LIMIT")
+// TracingConfig selects where trace spans are exported to
+type TracingConfig struct {
+	// Exporter is one of zpages, jaeger, ocagent or file
+	Exporter       string  `toml:"exporter" env:"TRACING_EXPORTER"`
+	SampleFraction float64 `toml:"sample_fraction" env:"TRACING_SAMPLE_FRACTION"`
+	// Endpoint is the jaeger collector URL or the ocagent address
+	Endpoint string `toml:"endpoint" env:"TRACING_ENDPOINT"`
+	File     string `toml:"file" env:"TRACING_FILE"`
 }
 
 type DanDemandConfig struct {
 	Server *ServerConfig `toml:"server"`
 	Slack  *SlackConfig  `toml:"slack"`
 	Twilio *TwilioConfig `toml:"twilio"`
+	Demand *DemandConfig `toml:"demand"`
+
+	Escalation *EscalationConfig `toml:"escalation"`
+	Email      *EmailConfig      `toml:"email"`
+	Logging    *LoggingConfig    `toml:"logging"`
+	Capture    *CaptureConfig    `toml:"capture"`
+	Tracing    *TracingConfig    `toml:"tracing"`
 }
 
-func (ddc *DanDemandConfig) InitFromEnv() {
-	ddc.Server = &ServerConfig{}
-	ddc.Server.InitFromEnv()
+// configLayer is a set of settings keyed by "section.key" that all came from the same source
+type configLayer struct {
+	source string
+	values map[string]interface{}
+}
 
-	ddc.Slack = &SlackConfig{}
-	ddc.Slack.InitFromEnv()
+// configField is a single setting within a DanDemandConfig
+type configField struct {
+	key   string
+	env   string
+	value reflect.Value
+}
 
-	ddc.Twilio = &TwilioConfig{}
-	ddc.Twilio.InitFromEnv()
+// newDanDemandConfig returns a config with every section allocated and no settings applied
+func newDanDemandConfig() *DanDemandConfig {
+	return &DanDemandConfig{
+		Server:     &ServerConfig{},
+		Slack:      &SlackConfig{},
+		Twilio:     &TwilioConfig{},
+		Demand:     &DemandConfig{},
+		Escalation: &EscalationConfig{},
+		Email:      &EmailConfig{},
+		Logging:    &LoggingConfig{},
+		Capture:    &CaptureConfig{},
+		Tracing:    &TracingConfig{},
+	}
 }
 
-func LoadConfig(path string) (*DanDemandConfig, error) {
-	config := &DanDemandConfig{}
-	config.InitFromEnv()
+// fields returns every setting in the config keyed by "section.key"
+func (ddc *DanDemandConfig) fields() map[string]configField {
+	fields := make(map[string]configField)
+	root := reflect.ValueOf(ddc).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Type().Field(i).Tag.Get("toml")
+		sectionVal := root.Field(i).Elem()
+		for j := 0; j < sectionVal.NumField(); j++ {
+			fieldType := sectionVal.Type().Field(j)
+			key := section + "." + fieldType.Tag.Get("toml")
+			fields[key] = configField{
+				key:   key,
+				env:   fieldType.Tag.Get("env"),
+				value: sectionVal.Field(j),
+			}
+		}
+	}
+	return fields
+}
 
-	if path != "" {
-		data, err := ioutil.ReadFile(path)
+// setField assigns a raw setting to a config field. Raw values are either strings (from the
+// environment and flags) or the native types produced by the toml parser.
+func setField(field reflect.Value, raw interface{}) error {
+	switch field.Kind() {
+	case reflect.String:
+		val, ok := raw.(string)
+		if !ok {
+			return errors.Errorf("expected a string, got %v", raw)
+		}
+		field.SetString(val)
+	case reflect.Int:
+		switch val := raw.(type) {
+		case int:
+			field.SetInt(int64(val))
+		case int64:
+			field.SetInt(val)
+		case string:
+			parsed, err := strconv.Atoi(val)
+			if err != nil {
+				return errors.Errorf("expected an integer, got %q", val)
+			}
+			field.SetInt(int64(parsed))
+		default:
+			return errors.Errorf("expected an integer, got %v", raw)
+		}
+	case reflect.Float64:
+		switch val := raw.(type) {
+		case float64:
+			field.SetFloat(val)
+		case int:
+			field.SetFloat(float64(val))
+		case int64:
+			field.SetFloat(float64(val))
+		case string:
+			parsed, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return errors.Errorf("expected a number, got %q", val)
+			}
+			field.SetFloat(parsed)
+		default:
+			return errors.Errorf("expected a number, got %v", raw)
+		}
+	case reflect.Slice:
+		// Lists are toml arrays in the config file and comma separated everywhere else
+		var vals []string
+		switch val := raw.(type) {
+		case []interface{}:
+			for _, item := range val {
+				str, ok := item.(string)
+				if !ok {
+					return errors.Errorf("expected a list of strings, got %v", raw)
+				}
+				vals = append(vals, str)
+			}
+		case string:
+			for _, item := range strings.Split(val, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					vals = append(vals, item)
+				}
+			}
+		default:
+			return errors.Errorf("expected a list of strings, got %v", raw)
+		}
+		field.Set(reflect.ValueOf(vals))
+	case reflect.Bool:
+		switch val := raw.(type) {
+		case bool:
+			field.SetBool(val)
+		case string:
+			parsed, err := strconv.ParseBool(val)
+			if err != nil {
+				return errors.Errorf("expected true or false, got %q", val)
+			}
+			field.SetBool(parsed)
+		default:
+			return errors.Errorf("expected true or false, got %v", raw)
+		}
+	default:
+		return errors.Errorf("unsupported setting type %s", field.Kind())
+	}
+	return nil
+}
+
+// apply sets every value in the layer on the config. A layer that sets a secret or its _file
+// variant clears the other one, so the highest layer always decides where a secret comes from.
+func (ddc *DanDemandConfig) apply(layer configLayer) error {
+	fields := ddc.fields()
+	keys := make([]string, 0, len(layer.values))
+	for key := range layer.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		field, ok := fields[key]
+		if !ok {
+			return errors.Errorf("unknown setting %q in %s", key, layer.source)
+		}
+		if err := setField(field.value, layer.values[key]); err != nil {
+			return errors.Wrapf(err, "invalid %q in %s: ", key, layer.source)
+		}
+
+		var sibling string
+		if strings.HasSuffix(key, secretFileSuffix) {
+			sibling = strings.TrimSuffix(key, secretFileSuffix)
+		} else {
+			sibling = key + secretFileSuffix
+		}
+		if siblingField, ok := fields[sibling]; ok {
+			if _, set := layer.values[sibling]; set {
+				return errors.Errorf("only one of %q and %q may be set in %s", key, sibling, layer.source)
+			}
+			siblingField.value.Set(reflect.Zero(siblingField.value.Type()))
+		}
+	}
+	return nil
+}
+
+// resolveSecretFiles reads every *_file setting into its sibling setting. Settings like
+// demand.state_file that have no sibling are plain paths and left alone.
+func (ddc *DanDemandConfig) resolveSecretFiles() error {
+	fields := ddc.fields()
+	for key, field := range fields {
+		if !strings.HasSuffix(key, secretFileSuffix) || field.value.String() == "" {
+			continue
+		}
+		secret, ok := fields[strings.TrimSuffix(key, secretFileSuffix)]
+		if !ok {
+			continue
+		}
+		data, err := ioutil.ReadFile(field.value.String())
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to read config file: ")
+			return errors.Wrapf(err, "failed to read %q: ", key)
+		}
+		secret.value.SetString(strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+func defaultsLayer() configLayer {
+	return configLayer{
+		source: "defaults",
+		values: map[string]interface{}{
+			"server.address":          defaultServerAddress,
+			"server.zpages_address":   defaultZPagesAddress,
+			"slack.handler_mode":      defaultHandlerMode,
+			"slack.api_url":           defaultSlackAPIURL,
+			"slack.user_format":       defaultUserFormat,
+			"twilio.rate_limit":       defaultTwilioLimit,
+			"twilio.base_url":         defaultTwilioBaseURL,
+			"demand.thread_replies":   defaultThreadReplies,
+			"demand.thread_segments":  defaultThreadSegments,
+			"demand.edit_window":      defaultEditWindow,
+			"escalation.keyword":      defaultEscalationKeyword,
+			"email.after_chunks":      defaultEmailAfterChunks,
+			"logging.format":          defaultLogFormat,
+			"logging.level":           defaultLogLevel,
+			"capture.max_size_mb":     defaultCaptureMaxSizeMB,
+			"capture.backups":         defaultCaptureBackups,
+			"tracing.exporter":        defaultTraceExporter,
+			"tracing.sample_fraction": defaultTraceSampleFraction,
+		},
+	}
+}
+
+// fileLayer loads every setting present in a TOML config file
+func fileLayer(path string) (configLayer, error) {
+	layer := configLayer{source: path, values: make(map[string]interface{})}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return layer, errors.Wrap(err, "failed to read config file: ")
+	}
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return layer, errors.Wrap(err, "failed to unmarshal config")
+	}
+	for _, section := range tree.Keys() {
+		sectionTree, ok := tree.Get(section).(*toml.Tree)
+		if !ok {
+			return layer, errors.Errorf("%q in %s must be a [%s] table", section, path, section)
+		}
+		for _, key := range sectionTree.Keys() {
+			layer.values[section+"."+key] = sectionTree.Get(key)
+		}
+	}
+	return layer, nil
+}
+
+// envLayer collects every setting that has a non-empty environment variable
+func envLayer() configLayer {
+	layer := configLayer{source: "environment", values: make(map[string]interface{})}
+	for key, field := range newDanDemandConfig().fields() {
+		if field.env == "" {
+			continue
+		}
+		if val := os.Getenv(field.env); val != "" {
+			layer.values[key] = val
 		}
+	}
+	return layer
+}
 
-		if err := toml.Unmarshal(data, config); err != nil {
-			return nil, errors.Wrap(err, "failed to unmarshal config")
+// flagLayer parses "section.key=value" overrides given on the command line
+func flagLayer(overrides []string) (configLayer, error) {
+	layer := configLayer{source: "flags", values: make(map[string]interface{})}
+	for _, override := range overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) != 2 {
+			return layer, errors.Errorf("override %q must look like section.key=value", override)
 		}
+		layer.values[parts[0]] = parts[1]
 	}
+	return layer, nil
+}
 
-	if config.Server.Address == "" {
-		config.Server.Address = defaultServerAddress
+// LoadConfig builds the configuration from, in increasing order of precedence: built in defaults,
+// the config file at path (if any), environment variables and command line overrides. Secrets
+// given as *_file settings are read last.
+func LoadConfig(path string, overrides []string) (*DanDemandConfig, error) {
+	layers := []configLayer{defaultsLayer()}
+	if path != "" {
+		layer, err := fileLayer(path)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	layers = append(layers, envLayer())
+	layer, err := flagLayer(overrides)
+	if err != nil {
+		return nil, err
 	}
-	if config.Server.ZPagesAddress == "" {
-		config.Server.ZPagesAddress = defaultZPagesAddress
+	layers = append(layers, layer)
+
+	config := newDanDemandConfig()
+	for _, layer := range layers {
+		if err := config.apply(layer); err != nil {
+			return nil, err
+		}
 	}
-	if config.Twilio.Limit == "" {
-		config.Twilio.Limit = defaultTwilioLimit
+	if err := config.resolveSecretFiles(); err != nil {
+		return nil, err
 	}
 	return config, nil
 }
+
+// redactedValue replaces secrets when displaying the configuration
+const redactedValue = "<redacted>"
+
+// Redacted returns every setting keyed by "section.key" with secrets replaced. A setting is a
+// secret if it can also be read from a file.
+func (ddc *DanDemandConfig) Redacted() map[string]interface{} {
+	fields := ddc.fields()
+	values := make(map[string]interface{}, len(fields))
+	for key, field := range fields {
+		values[key] = field.value.Interface()
+		if _, secret := fields[key+secretFileSuffix]; secret && field.value.String() != "" {
+			values[key] = redactedValue
+		}
+	}
+	return values
+}
+
+// stringsFlag is a flag.Value that collects every occurrence of a repeated flag
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return fmt.Sprint(*sf)
+}
+
+func (sf *stringsFlag) Set(val string) error {
+	*sf = append(*sf, val)
+	return nil
+}
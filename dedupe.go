@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Deduper remembers keys for a fixed window so the same slack message is never turned into more
+// than one demand, whether it arrives via a mention, a reaction, or a slack retry.
+type Deduper struct {
+	window time.Duration
+
+	lock      sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewDeduper(window time.Duration) *Deduper {
+	return &Deduper{
+		window:    window,
+		seen:      make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// sweep drops every key older than the window. The caller must hold the lock.
+func (d *Deduper) sweep(now time.Time) {
+	for key, at := range d.seen {
+		if now.Sub(at) > d.window {
+			delete(d.seen, key)
+		}
+	}
+	d.lastSweep = now
+}
+
+// Seen marks the key as seen and reports whether it had already been marked within the window.
+func (d *Deduper) Seen(key string) bool {
+	now := time.Now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if now.Sub(d.lastSweep) > d.window {
+		d.sweep(now)
+	}
+	if at, ok := d.seen[key]; ok && now.Sub(at) <= d.window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
+
+// Forget removes a key so a failed demand can be attempted again.
+func (d *Deduper) Forget(key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.seen, key)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+)
+
+// mentionPattern matches user mentions in message text, e.g. <@U024BE7LH> or <@U024BE7LH|bob>.
+// Enterprise grid users have IDs starting with W.
+var mentionPattern = regexp.MustCompile(`<@([UW][A-Z0-9]+)(\|[^>]*)?>`)
+
+// How users are shown, slack.user_format is either one of these or a template using them as
+// placeholders, e.g. "{display} ({real})"
+const (
+	userFormatHandle  = "handle"
+	userFormatDisplay = "display"
+	userFormatReal    = "real"
+)
+
+var (
+	userFormatPlaceholder = regexp.MustCompile(`\{([a-z]+)\}`)
+	// emptyBrackets is what is left of "({real})" and the like when the name was already shown
+	emptyBrackets = regexp.MustCompile(`\(\s*\)|\[\s*\]|<\s*>`)
+	spaces        = regexp.MustCompile(`\s{2,}`)
+)
+
+// validateUserFormat checks a slack.user_format value
+func validateUserFormat(format string) error {
+	switch format {
+	case userFormatHandle, userFormatDisplay, userFormatReal:
+		return nil
+	}
+	placeholders := userFormatPlaceholder.FindAllStringSubmatch(format, -1)
+	if len(placeholders) == 0 {
+		return errors.Errorf("%q is not one of %q, %q or %q and has no {placeholders}", format, userFormatHandle, userFormatDisplay, userFormatReal)
+	}
+	for _, placeholder := range placeholders {
+		switch placeholder[1] {
+		case userFormatHandle, userFormatDisplay, userFormatReal:
+		default:
+			return errors.Errorf("unknown placeholder %q, use {%s}, {%s} or {%s}", placeholder[0], userFormatHandle, userFormatDisplay, userFormatReal)
+		}
+	}
+	return nil
+}
+
+// DirectoryEntry is what we keep about a single workspace member
+type DirectoryEntry struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	RealName    string `json:"real_name,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	TZ          string `json:"tz,omitempty"`
+	Deleted     bool   `json:"deleted,omitempty"`
+	IsBot       bool   `json:"is_bot,omitempty"`
+}
+
+// field returns a single name of the user. Display and real names fall back to each other and
+// then to the handle, since slack leaves them empty for many accounts.
+func (de DirectoryEntry) field(name string) string {
+	var candidates []string
+	switch name {
+	case userFormatDisplay:
+		candidates = []string{de.DisplayName, de.RealName}
+	case userFormatReal:
+		candidates = []string{de.RealName, de.DisplayName}
+	}
+	for _, candidate := range candidates {
+		if candidate = strings.TrimSpace(candidate); candidate != "" {
+			return candidate
+		}
+	}
+	return de.Name
+}
+
+// Format renders the user according to a slack.user_format value. Template placeholders fall back
+// like the plain formats do and a name already shown earlier in the template is left out, so
+// "{display} ({real})" becomes just "Alice Smith" for a user without a display name.
+func (de DirectoryEntry) Format(format string) string {
+	switch format {
+	case "", userFormatHandle:
+		return de.Name
+	case userFormatDisplay, userFormatReal:
+		return de.field(format)
+	}
+	shown := make(map[string]bool)
+	text := userFormatPlaceholder.ReplaceAllStringFunc(format, func(placeholder string) string {
+		name := de.field(placeholder[1 : len(placeholder)-1])
+		if shown[name] {
+			return ""
+		}
+		shown[name] = true
+		return name
+	})
+	return strings.TrimSpace(spaces.ReplaceAllString(emptyBrackets.ReplaceAllString(text, ""), " "))
+}
+
+func newDirectoryEntry(user slack.User) DirectoryEntry {
+	return DirectoryEntry{
+		ID:          user.ID,
+		Name:        user.Name,
+		RealName:    user.RealName,
+		DisplayName: user.Profile.DisplayName,
+		TZ:          user.TZ,
+		Deleted:     user.Deleted,
+		IsBot:       user.IsBot,
+	}
+}
+
+// directoryChanges counts what changed when entries were added to a UserDirectory
+type directoryChanges struct {
+	Added       int
+	Renamed     int
+	Deactivated int
+}
+
+// diff records the difference between the previous entry for a user, if any, and its new entry
+func (dc *directoryChanges) diff(old DirectoryEntry, existed bool, entry DirectoryEntry) {
+	switch {
+	case !existed:
+		dc.Added++
+	case old.Name != entry.Name:
+		dc.Renamed++
+	}
+	if existed && !old.Deleted && entry.Deleted {
+		dc.Deactivated++
+	}
+}
+
+// UserDirectory indexes workspace members by user ID. Lookups only take a read lock and a full
+// refresh swaps in a new index, so neither blocks on the other for long.
+type UserDirectory struct {
+	lock  sync.RWMutex
+	users map[string]DirectoryEntry
+	// updated is when each user was last changed by Put, so a refresh that started earlier does
+	// not undo it
+	updated map[string]time.Time
+	// lastRefresh is when the full user list was last loaded
+	lastRefresh time.Time
+	// dirty is set when the directory changed since it was last saved
+	dirty bool
+	// format is how users are rendered by Name and ReplaceMentions
+	format string
+}
+
+// directorySnapshot is the on-disk form of a UserDirectory
+type directorySnapshot struct {
+	// UpdatedAt is when the full user list the snapshot is based on was loaded
+	UpdatedAt time.Time        `json:"updated_at"`
+	Users     []DirectoryEntry `json:"users"`
+}
+
+func NewUserDirectory() *UserDirectory {
+	return &UserDirectory{
+		users:   make(map[string]DirectoryEntry),
+		updated: make(map[string]time.Time),
+	}
+}
+
+// Get returns the entry for a user
+func (ud *UserDirectory) Get(uid string) (DirectoryEntry, bool) {
+	ud.lock.RLock()
+	defer ud.lock.RUnlock()
+	entry, ok := ud.users[uid]
+	return entry, ok
+}
+
+// SetFormat changes how users are rendered, see DirectoryEntry.Format
+func (ud *UserDirectory) SetFormat(format string) {
+	ud.lock.Lock()
+	defer ud.lock.Unlock()
+	ud.format = format
+}
+
+// Name returns how a user should be shown
+func (ud *UserDirectory) Name(uid string) (string, bool) {
+	ud.lock.RLock()
+	defer ud.lock.RUnlock()
+	entry, ok := ud.users[uid]
+	return entry.Format(ud.format), ok
+}
+
+// Put adds or updates a single user
+func (ud *UserDirectory) Put(user slack.User) directoryChanges {
+	entry := newDirectoryEntry(user)
+	ud.lock.Lock()
+	defer ud.lock.Unlock()
+	var changes directoryChanges
+	old, existed := ud.users[user.ID]
+	changes.diff(old, existed, entry)
+	ud.users[user.ID] = entry
+	ud.updated[user.ID] = time.Now()
+	ud.dirty = ud.dirty || changes != (directoryChanges{})
+	return changes
+}
+
+// Replace swaps the whole directory for a set of users listed starting at listedAt. Users changed
+// by Put since then keep their newer entry.
+func (ud *UserDirectory) Replace(users []slack.User, listedAt time.Time) directoryChanges {
+	index := make(map[string]DirectoryEntry, len(users))
+	for _, user := range users {
+		index[user.ID] = newDirectoryEntry(user)
+	}
+
+	ud.lock.Lock()
+	defer ud.lock.Unlock()
+	old := ud.users
+	for uid, updated := range ud.updated {
+		if updated.After(listedAt) {
+			index[uid] = old[uid]
+		} else {
+			delete(ud.updated, uid)
+		}
+	}
+	var changes directoryChanges
+	for uid, entry := range index {
+		previous, existed := old[uid]
+		changes.diff(previous, existed, entry)
+	}
+	ud.users = index
+	ud.lastRefresh = time.Now()
+	ud.dirty = true
+	return changes
+}
+
+// Len returns the number of users in the directory
+func (ud *UserDirectory) Len() int {
+	ud.lock.RLock()
+	defer ud.lock.RUnlock()
+	return len(ud.users)
+}
+
+// LastRefresh returns when the full user list was last loaded, it is zero until the first refresh
+func (ud *UserDirectory) LastRefresh() time.Time {
+	ud.lock.RLock()
+	defer ud.lock.RUnlock()
+	return ud.lastRefresh
+}
+
+// Names returns a copy of the UID to user name mapping
+func (ud *UserDirectory) Names() map[string]string {
+	ud.lock.RLock()
+	defer ud.lock.RUnlock()
+	names := make(map[string]string, len(ud.users))
+	for uid, entry := range ud.users {
+		names[uid] = entry.Name
+	}
+	return names
+}
+
+// ReplaceMentions rewrites every mention of a known user as <@name> using the configured format.
+// Mentions of unknown users are left alone.
+func (ud *UserDirectory) ReplaceMentions(text string) string {
+	ud.lock.RLock()
+	defer ud.lock.RUnlock()
+	return mentionPattern.ReplaceAllStringFunc(text, func(mention string) string {
+		uid := mentionPattern.FindStringSubmatch(mention)[1]
+		if entry, ok := ud.users[uid]; ok {
+			return "<@" + entry.Format(ud.format) + ">"
+		}
+		return mention
+	})
+}
+
+// Load replaces the directory with a snapshot written by Save. A missing snapshot is not an error.
+func (ud *UserDirectory) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to read user snapshot: ")
+	}
+	var snapshot directorySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return errors.Wrap(err, "failed to unmarshal user snapshot: ")
+	}
+
+	index := make(map[string]DirectoryEntry, len(snapshot.Users))
+	for _, entry := range snapshot.Users {
+		index[entry.ID] = entry
+	}
+	ud.lock.Lock()
+	defer ud.lock.Unlock()
+	ud.users = index
+	ud.updated = make(map[string]time.Time)
+	ud.lastRefresh = snapshot.UpdatedAt
+	ud.dirty = false
+	return nil
+}
+
+// Save writes the directory to path if it changed since it was loaded or last saved
+func (ud *UserDirectory) Save(path string) error {
+	ud.lock.Lock()
+	if !ud.dirty {
+		ud.lock.Unlock()
+		return nil
+	}
+	snapshot := directorySnapshot{
+		UpdatedAt: ud.lastRefresh,
+		Users:     make([]DirectoryEntry, 0, len(ud.users)),
+	}
+	for _, entry := range ud.users {
+		snapshot.Users = append(snapshot.Users, entry)
+	}
+	ud.dirty = false
+	ud.lock.Unlock()
+
+	sort.Slice(snapshot.Users, func(i, j int) bool {
+		return snapshot.Users[i].ID < snapshot.Users[j].ID
+	})
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal user snapshot: ")
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		ud.lock.Lock()
+		ud.dirty = true
+		ud.lock.Unlock()
+		return errors.Wrap(err, "failed to write user snapshot: ")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+func TestReplaceMentions(t *testing.T) {
+	directory := NewUserDirectory()
+	directory.Replace([]slack.User{
+		{ID: "U00000001", Name: "alice"},
+		{ID: "W00000002", Name: "bob"},
+	}, time.Now())
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"<@U00000001> lunch?", "<@alice> lunch?"},
+		{"ask <@W00000002|bob> and <@U00000001>", "ask <@bob> and <@alice>"},
+		{"<@U99999999> is unknown", "<@U99999999> is unknown"},
+		{"U00000001 is not a mention", "U00000001 is not a mention"},
+		{"<#C00000001|general> <!here>", "<#C00000001|general> <!here>"},
+	}
+	for _, test := range tests {
+		if got := directory.ReplaceMentions(test.text); got != test.want {
+			t.Errorf("ReplaceMentions(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestDirectoryChanges(t *testing.T) {
+	directory := NewUserDirectory()
+	directory.Replace([]slack.User{
+		{ID: "U00000001", Name: "alice"},
+		{ID: "U00000002", Name: "bob"},
+	}, time.Now())
+
+	changes := directory.Replace([]slack.User{
+		{ID: "U00000001", Name: "alice2"},
+		{ID: "U00000002", Name: "bob", Deleted: true},
+		{ID: "U00000003", Name: "carol"},
+	}, time.Now())
+	want := directoryChanges{Added: 1, Renamed: 1, Deactivated: 1}
+	if changes != want {
+		t.Errorf("expected %+v, got %+v", want, changes)
+	}
+
+	changes = directory.Put(slack.User{ID: "U00000003", Name: "carol"})
+	if changes != (directoryChanges{}) {
+		t.Errorf("expected an unchanged user to report no changes, got %+v", changes)
+	}
+	if entry, _ := directory.Get("U00000002"); !entry.Deleted {
+		t.Errorf("expected bob to be deactivated")
+	}
+}
+
+func TestRefreshKeepsNewerChanges(t *testing.T) {
+	directory := NewUserDirectory()
+	listedAt := time.Now()
+	directory.Put(slack.User{ID: "U00000001", Name: "alicia"})
+
+	// The list was fetched before the rename arrived
+	directory.Replace([]slack.User{{ID: "U00000001", Name: "alice"}}, listedAt)
+	if entry, _ := directory.Get("U00000001"); entry.Name != "alicia" {
+		t.Errorf("expected the rename to survive the refresh, got %q", entry.Name)
+	}
+
+	directory.Replace([]slack.User{{ID: "U00000001", Name: "alice"}}, time.Now())
+	if entry, _ := directory.Get("U00000001"); entry.Name != "alice" {
+		t.Errorf("expected a later refresh to win, got %q", entry.Name)
+	}
+}
+
+func TestDirectorySnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+
+	directory := NewUserDirectory()
+	listedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	directory.Replace([]slack.User{{ID: "U00000001", Name: "alice", TZ: "America/New_York", Deleted: true}}, listedAt)
+	if err := directory.Save(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	loaded := NewUserDirectory()
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	entry, ok := loaded.Get("U00000001")
+	if !ok || entry.Name != "alice" || entry.TZ != "America/New_York" || !entry.Deleted {
+		t.Errorf("snapshot did not round trip, got %+v", entry)
+	}
+	if !loaded.LastRefresh().Equal(directory.LastRefresh()) {
+		t.Errorf("expected updated_at %v, got %v", directory.LastRefresh(), loaded.LastRefresh())
+	}
+
+	// Nothing changed since loading so nothing is written
+	os.Remove(path)
+	if err := loaded.Save(path); err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected an unchanged directory not to be saved")
+	}
+	if err := NewUserDirectory().Load(path); err != nil {
+		t.Errorf("expected a missing snapshot to be ignored, got %v", err)
+	}
+}
+
+func TestFormatUser(t *testing.T) {
+	full := DirectoryEntry{Name: "asmith", DisplayName: "Ali", RealName: "Alice Smith"}
+	noDisplay := DirectoryEntry{Name: "asmith", RealName: "Alice Smith"}
+	handleOnly := DirectoryEntry{Name: "asmith"}
+
+	tests := []struct {
+		format string
+		entry  DirectoryEntry
+		want   string
+	}{
+		{userFormatHandle, full, "asmith"},
+		{userFormatDisplay, full, "Ali"},
+		{userFormatDisplay, noDisplay, "Alice Smith"},
+		{userFormatDisplay, handleOnly, "asmith"},
+		{userFormatReal, full, "Alice Smith"},
+		{userFormatReal, DirectoryEntry{Name: "asmith", DisplayName: "Ali"}, "Ali"},
+		{"{display} ({real})", full, "Ali (Alice Smith)"},
+		{"{display} ({real})", noDisplay, "Alice Smith"},
+		{"{display} ({real})", DirectoryEntry{Name: "ali", DisplayName: "Ali", RealName: "Ali"}, "Ali"},
+		{"{real} [{handle}]", noDisplay, "Alice Smith [asmith]"},
+		{"{display} ({real})", handleOnly, "asmith"},
+	}
+	for _, test := range tests {
+		if got := test.entry.Format(test.format); got != test.want {
+			t.Errorf("Format(%q) of %+v = %q, want %q", test.format, test.entry, got, test.want)
+		}
+	}
+
+	for _, format := range []string{"nickname", "{nick}", "{display} {nick}"} {
+		if validateUserFormat(format) == nil {
+			t.Errorf("expected %q to be rejected", format)
+		}
+	}
+}
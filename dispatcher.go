@@ -3,58 +3,215 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/golang/glog"
 	"github.com/nlopes/slack/slackevents"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 type eventHandlerFunc func(ctx context.Context, event interface{}) error
 type callbackHandlerFunc func(ctx context.Context, event interface{}) error
 
+const (
+	// slackSignatureMaxAge is how old a signed request may be before it is considered a replay
+	slackSignatureMaxAge = 5 * time.Minute
+
+	// handlerModeSequential runs every handler for an event one after another in priority order
+	handlerModeSequential = "sequential"
+	// handlerModeConcurrent runs every handler for an event in its own goroutine
+	handlerModeConcurrent = "concurrent"
+)
+
 var (
+	errBadSignature         = errors.New("slack signature does not match")
 	errInvalidEvent         = errors.New("invalid event passed to handler")
 	errInvalidCallbackEvent = errors.New("invalid CallbackEvent passed to handler")
 )
 
+// HandlerHandle is returned when registering a handler and can be used to unregister it later
+type HandlerHandle uint64
+
+// registeredHandler is a single named handler attached to an event or callback type
+type registeredHandler struct {
+	handle   HandlerHandle
+	name     string
+	priority int
+	fn       func(ctx context.Context, event interface{}) error
+}
+
+// handlerErrors collects the errors returned by every handler that failed for a single event
+type handlerErrors []error
+
+func (he handlerErrors) Error() string {
+	msgs := make([]string, 0, len(he))
+	for _, err := range he {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d handler(s) failed: %s", len(he), strings.Join(msgs, "; "))
+}
+
 // SlackEventDispatcher is an http.Handler implementor that attempts to dispatch slack events to
 // the handlers that are set for them. It also handles URL verification automatically so you don't
 // have to worry about it.
 type SlackEventDispatcher struct {
-	config SlackConfig
+	configLock sync.RWMutex
+	config     SlackConfig
 
-	// eventHandlers stores the mappings of top level events to functions that handle them
-	// map[string]eventHandlerFunc
-	eventHandlers *sync.Map
+	handlerLock sync.RWMutex
+	nextHandle  HandlerHandle
 
-	// callbackHandlers stores the mappings of
-	// map[string]eventHandlerFunc
-	callbackHandlers *sync.Map
+	// eventHandlers stores the mappings of top level events to the handlers attached to them,
+	// sorted by descending priority
+	eventHandlers map[string][]*registeredHandler
+
+	// callbackHandlers stores the mappings of callback event types to the handlers attached to
+	// them, sorted by descending priority
+	callbackHandlers map[string][]*registeredHandler
+
+	// capture records every verified event when set
+	capture *EventCapture
 }
 
 func NewSlackEventDispatcher(config SlackConfig) *SlackEventDispatcher {
 	return &SlackEventDispatcher{
 		config:           config,
-		eventHandlers:    &sync.Map{},
-		callbackHandlers: &sync.Map{},
+		eventHandlers:    make(map[string][]*registeredHandler),
+		callbackHandlers: make(map[string][]*registeredHandler),
 	}
 }
 
-// SetEventHandler sets the handler for a given top level slack event. There can only be one handler
-// per event at a time.
-func (sed *SlackEventDispatcher) SetEventHandler(etype string, handler eventHandlerFunc) {
-	glog.V(2).Infof("setting event handler '%s' -> %#v", etype, handler)
-	sed.eventHandlers.Store(etype, handler)
+// SetConfig swaps the configuration used for new events
+func (sed *SlackEventDispatcher) SetConfig(config SlackConfig) {
+	sed.configLock.Lock()
+	defer sed.configLock.Unlock()
+	sed.config = config
 }
 
-// SetCallbackHandler sets the handler for a given callback type. There can only be one handler per
-// callback at a time.
-func (sed *SlackEventDispatcher) SetCallbackHandler(ctype string, handler callbackHandlerFunc) {
-	glog.V(2).Infof("setting callback handler '%s' -> %#v", ctype, handler)
-	sed.callbackHandlers.Store(ctype, handler)
+// SetCapture records every verified event to capture, it must be called before serving
+func (sed *SlackEventDispatcher) SetCapture(capture *EventCapture) {
+	sed.capture = capture
+}
+
+// currentConfig returns the configuration to use for an event
+func (sed *SlackEventDispatcher) currentConfig() SlackConfig {
+	sed.configLock.RLock()
+	defer sed.configLock.RUnlock()
+	return sed.config
+}
+
+// addHandler inserts a handler into the given table keeping the per-type slice ordered by
+// priority. Handlers with equal priority run in registration order.
+func (sed *SlackEventDispatcher) addHandler(table map[string][]*registeredHandler, key, name string, priority int, fn func(context.Context, interface{}) error) HandlerHandle {
+	sed.handlerLock.Lock()
+	defer sed.handlerLock.Unlock()
+	sed.nextHandle++
+	rh := &registeredHandler{
+		handle:   sed.nextHandle,
+		name:     name,
+		priority: priority,
+		fn:       fn,
+	}
+	// Copy on write so dispatches holding the old slice are unaffected
+	handlers := make([]*registeredHandler, 0, len(table[key])+1)
+	handlers = append(handlers, table[key]...)
+	handlers = append(handlers, rh)
+	sort.SliceStable(handlers, func(i, j int) bool {
+		return handlers[i].priority > handlers[j].priority
+	})
+	table[key] = handlers
+	return rh.handle
+}
+
+// AddEventHandler attaches a named handler to a given top level slack event. Handlers with a
+// higher priority are run first when the dispatcher is in sequential mode.
+func (sed *SlackEventDispatcher) AddEventHandler(etype, name string, priority int, handler eventHandlerFunc) HandlerHandle {
+	logger.WithFields(logrus.Fields{"event": etype, "handler": name, "priority": priority}).Debug("adding event handler")
+	return sed.addHandler(sed.eventHandlers, etype, name, priority, handler)
+}
+
+// AddCallbackHandler attaches a named handler to a given callback type. Handlers with a higher
+// priority are run first when the dispatcher is in sequential mode.
+func (sed *SlackEventDispatcher) AddCallbackHandler(ctype, name string, priority int, handler callbackHandlerFunc) HandlerHandle {
+	logger.WithFields(logrus.Fields{"callback": ctype, "handler": name, "priority": priority}).Debug("adding callback handler")
+	return sed.addHandler(sed.callbackHandlers, ctype, name, priority, handler)
+}
+
+// RemoveHandler unregisters the handler associated with the given handle. It returns false if the
+// handle is unknown.
+func (sed *SlackEventDispatcher) RemoveHandler(handle HandlerHandle) bool {
+	sed.handlerLock.Lock()
+	defer sed.handlerLock.Unlock()
+	for _, table := range []map[string][]*registeredHandler{sed.eventHandlers, sed.callbackHandlers} {
+		for key, handlers := range table {
+			for index, rh := range handlers {
+				if rh.handle != handle {
+					continue
+				}
+				logger.WithFields(logrus.Fields{"type": key, "handler": rh.name}).Debug("removing handler")
+				remaining := make([]*registeredHandler, 0, len(handlers)-1)
+				remaining = append(remaining, handlers[:index]...)
+				remaining = append(remaining, handlers[index+1:]...)
+				if len(remaining) == 0 {
+					delete(table, key)
+				} else {
+					table[key] = remaining
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookupHandlers returns the handlers registered for the given key in the given table
+func (sed *SlackEventDispatcher) lookupHandlers(table map[string][]*registeredHandler, key string) []*registeredHandler {
+	sed.handlerLock.RLock()
+	defer sed.handlerLock.RUnlock()
+	return table[key]
+}
+
+// runHandlers executes every handler with the given event, either sequentially or concurrently
+// depending on the configured handler mode. Every handler is run even if an earlier one fails and
+// all errors are collected into a handlerErrors.
+func (sed *SlackEventDispatcher) runHandlers(ctx context.Context, etype string, handlers []*registeredHandler, event interface{}) error {
+	var errs handlerErrors
+	if sed.currentConfig().HandlerMode == handlerModeConcurrent {
+		var errLock sync.Mutex
+		var wg sync.WaitGroup
+		for _, rh := range handlers {
+			wg.Add(1)
+			go func(rh *registeredHandler) {
+				defer wg.Done()
+				if err := rh.fn(ctx, event); err != nil {
+					errLock.Lock()
+					errs = append(errs, errors.Wrapf(err, "handler '%s' for '%s' failed", rh.name, etype))
+					errLock.Unlock()
+				}
+			}(rh)
+		}
+		wg.Wait()
+	} else {
+		for _, rh := range handlers {
+			if err := rh.fn(ctx, event); err != nil {
+				errs = append(errs, errors.Wrapf(err, "handler '%s' for '%s' failed", rh.name, etype))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 // handleURLVerification is a special case where we need to decode the body differently so we set
@@ -68,21 +225,61 @@ func (sed *SlackEventDispatcher) handleURLVerification(body []byte) ([]byte, err
 	return []byte(resp.Challenge), nil
 }
 
+// verifySlackSignature checks the X-Slack-Signature of a request against the signing secret
+func verifySlackSignature(header http.Header, body []byte, secret string, now time.Time) error {
+	timestamp, err := strconv.ParseInt(header.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "missing or invalid X-Slack-Request-Timestamp: ")
+	}
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > slackSignatureMaxAge || age < -slackSignatureMaxAge {
+		return errors.Errorf("request timestamp is %v old", age)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:", timestamp)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return errBadSignature
+	}
+	return nil
+}
+
 func (sed *SlackEventDispatcher) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	var buf bytes.Buffer
 	buf.ReadFrom(req.Body)
+	if secret := sed.currentConfig().SigningSecret; secret != "" {
+		if err := verifySlackSignature(req.Header, buf.Bytes(), secret, time.Now()); err != nil {
+			logger.WithError(err).Warning("rejected slack event with an invalid signature")
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
 	apiEvent, err := slackevents.ParseEvent(
 		json.RawMessage(buf.String()),
 		slackevents.OptionVerifyToken(
-			&slackevents.TokenComparator{VerificationToken: sed.config.VerificationToken},
+			&slackevents.TokenComparator{VerificationToken: sed.currentConfig().VerificationToken},
 		),
 	)
 	if err != nil {
-		glog.Error(errors.Wrap(err, "failed to parse event: %v"))
+		logger.WithError(err).Error("failed to parse event")
 		resp.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// Slack retries events it did not get a timely response for with the same event_id, so it
+	// ties together everything done on behalf of a single event
+	ctx := req.Context()
+	if callback, ok := apiEvent.Data.(*slackevents.EventsAPICallbackEvent); ok && callback.EventID != "" {
+		ctx = withCorrelationID(ctx, callback.EventID)
+	}
+	if sed.capture != nil {
+		if err := sed.capture.Capture(req.Header, buf.Bytes()); err != nil {
+			loggerFrom(ctx).WithError(err).Warning("failed to capture slack event")
+		}
+	}
+
 	var body []byte
 	var handlerErr error
 
@@ -92,31 +289,31 @@ func (sed *SlackEventDispatcher) ServeHTTP(resp http.ResponseWriter, req *http.R
 		resp.Header().Set("Content-Type", "text")
 	case slackevents.CallbackEvent:
 		inner := apiEvent.InnerEvent
-		if handler, ok := sed.callbackHandlers.Load(inner.Type); ok {
+		if handlers := sed.lookupHandlers(sed.callbackHandlers, inner.Type); len(handlers) > 0 {
 			err = errors.Wrapf(
-				handler.(callbackHandlerFunc)(req.Context(), inner.Data),
-				"failed to execute CallbackEvent handler for '%s': ",
+				sed.runHandlers(ctx, inner.Type, handlers, inner.Data),
+				"failed to execute CallbackEvent handlers for '%s': ",
 				inner.Type,
 			)
 			if err != nil {
-				glog.Error(errors.Wrap(err, "failed to dispatch callback: "))
+				loggerFrom(ctx).WithError(err).Error("failed to dispatch callback")
 			}
 		} else {
-			glog.Infof("no callback handler for %#v", inner.Type)
+			loggerFrom(ctx).WithField("callback", inner.Type).Info("no callback handler")
 		}
 	default:
-		if handler, ok := sed.eventHandlers.Load(apiEvent.Type); ok {
+		if handlers := sed.lookupHandlers(sed.eventHandlers, apiEvent.Type); len(handlers) > 0 {
 			handlerErr = errors.Wrapf(
-				handler.(eventHandlerFunc)(req.Context(), apiEvent),
-				"failed to execute Event handler for '%s': ",
+				sed.runHandlers(ctx, apiEvent.Type, handlers, apiEvent),
+				"failed to execute Event handlers for '%s': ",
 				apiEvent.Type,
 			)
 		} else {
-			glog.Infof("no event handler for %#v", apiEvent.Type)
+			loggerFrom(ctx).WithField("event", apiEvent.Type).Info("no event handler")
 		}
 	}
 	if handlerErr != nil {
-		glog.Error(errors.Wrap(handlerErr, "failed to dispatch slack events: "))
+		loggerFrom(ctx).WithError(handlerErr).Error("failed to dispatch slack events")
 		resp.WriteHeader(http.StatusInternalServerError)
 	} else {
 		resp.WriteHeader(http.StatusOK)
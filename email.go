@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+const (
+	// emailAttachmentLimit is the total size of the files attached to a single email, most mail
+	// servers reject messages much larger than this
+	emailAttachmentLimit = 20 * mb
+	// base64LineLength is how many encoded characters go on each line of an attachment
+	base64LineLength = 76
+)
+
+// channelEmail is the channel recorded for demands that were emailed instead of texted
+const channelEmail = "email"
+
+var (
+	// slackLinkPattern matches the <...> tokens slack uses for links, mentions and channels
+	slackLinkPattern = regexp.MustCompile(`<([^<>]+)>`)
+	mrkdwnCode       = regexp.MustCompile("`([^`\n]+)`")
+	mrkdwnBold       = regexp.MustCompile(`\*([^*\n]+)\*`)
+	mrkdwnItalic     = regexp.MustCompile(`(^|\W)_([^_\n]+)_(\W|$)`)
+	mrkdwnStrike     = regexp.MustCompile(`~([^~\n]+)~`)
+)
+
+// EmailAttachment is a file attached to an email
+type EmailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// EmailMessage is an email to the Dan with both a plain text and an HTML body
+type EmailMessage struct {
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []EmailAttachment
+}
+
+// Mailer sends email through an SMTP server, using STARTTLS whenever the server offers it
+type Mailer struct {
+	address  string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func NewMailer(config *EmailConfig) (*Mailer, error) {
+	host, _, err := net.SplitHostPort(config.SMTPAddress)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse smtp_address '%s': ", config.SMTPAddress)
+	}
+	return &Mailer{
+		address:  config.SMTPAddress,
+		host:     host,
+		username: config.Username,
+		password: config.Password,
+		from:     config.From,
+	}, nil
+}
+
+// Send delivers msg, giving up once ctx expires
+func (m *Mailer) Send(ctx context.Context, msg EmailMessage) error {
+	data, err := buildEmail(m.from, msg)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.address)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to smtp server: ")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// net/smtp knows nothing about contexts, closing the connection unblocks it
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "failed to greet smtp server: ")
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return errors.Wrap(err, "failed to start tls: ")
+		}
+	}
+	if m.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return errors.Wrap(err, "failed to authenticate with smtp server: ")
+		}
+	}
+	if err := client.Mail(m.from); err != nil {
+		return errors.Wrap(err, "smtp server rejected sender: ")
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return errors.Wrap(err, "smtp server rejected recipient: ")
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return errors.Wrap(err, "failed to start sending email: ")
+	}
+	if _, err := writer.Write(data); err != nil {
+		return errors.Wrap(err, "failed to send email: ")
+	}
+	if err := writer.Close(); err != nil {
+		return errors.Wrap(err, "smtp server rejected email: ")
+	}
+	return client.Quit()
+}
+
+// buildEmail renders msg as a MIME message with the text and HTML bodies as alternatives,
+// followed by the attachments
+func buildEmail(from string, msg EmailMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	mixed := multipart.NewWriter(&buf)
+	headers := []string{
+		"From: " + from,
+		"To: " + msg.To,
+		"Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + mixed.Boundary(),
+	}
+	buf.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	var alternatives bytes.Buffer
+	alternative := multipart.NewWriter(&alternatives)
+	for _, body := range []struct{ contentType, text string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		part, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create email body: ")
+		}
+		encoder := quotedprintable.NewWriter(part)
+		encoder.Write([]byte(body.text))
+		encoder.Close()
+	}
+	alternative.Close()
+	part, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create email body: ")
+	}
+	part.Write(alternatives.Bytes())
+
+	for _, attachment := range msg.Attachments {
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		part, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name})},
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to attach '%s': ", attachment.Name)
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > base64LineLength {
+			part.Write([]byte(encoded[:base64LineLength] + "\r\n"))
+			encoded = encoded[base64LineLength:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to finish email: ")
+	}
+	return buf.Bytes(), nil
+}
+
+// renderSlackHTML renders slack's mrkdwn message formatting as HTML. Mentions must already be
+// replaced by names.
+func renderSlackHTML(text string) string {
+	var buf strings.Builder
+	blocks := strings.Split(text, "```")
+	for index, block := range blocks {
+		if index%2 == 1 {
+			buf.WriteString("<pre>" + renderSlackInline(block, false) + "</pre>")
+			continue
+		}
+		buf.WriteString(strings.Replace(renderSlackInline(block, true), "\n", "<br>\n", -1))
+	}
+	return buf.String()
+}
+
+// renderSlackInline renders links and mentions, and with format set the inline formatting, of a
+// piece of a slack message
+func renderSlackInline(text string, format bool) string {
+	var buf strings.Builder
+	last := 0
+	for _, match := range slackLinkPattern.FindAllStringSubmatchIndex(text, -1) {
+		buf.WriteString(renderSlackText(text[last:match[0]], format))
+		buf.WriteString(renderSlackToken(text[match[2]:match[3]]))
+		last = match[1]
+	}
+	buf.WriteString(renderSlackText(text[last:], format))
+	return buf.String()
+}
+
+// renderSlackText escapes plain message text, which slack sends with &, < and > escaped
+func renderSlackText(text string, format bool) string {
+	escaped := html.EscapeString(html.UnescapeString(text))
+	if !format {
+		return escaped
+	}
+	escaped = mrkdwnCode.ReplaceAllString(escaped, "<code>$1</code>")
+	escaped = mrkdwnBold.ReplaceAllString(escaped, "<b>$1</b>")
+	escaped = mrkdwnItalic.ReplaceAllString(escaped, "$1<i>$2</i>$3")
+	return mrkdwnStrike.ReplaceAllString(escaped, "<s>$1</s>")
+}
+
+// renderSlackToken renders what was inside a <...> token: a mention, channel, special mention
+// or link, each optionally followed by |label
+func renderSlackToken(token string) string {
+	target, label := token, ""
+	if parts := strings.SplitN(token, "|", 2); len(parts) == 2 {
+		target, label = parts[0], parts[1]
+	}
+	switch {
+	case strings.HasPrefix(target, "@"):
+		return html.EscapeString(html.UnescapeString(target))
+	case strings.HasPrefix(target, "#"):
+		if label != "" {
+			return "#" + html.EscapeString(html.UnescapeString(label))
+		}
+		return html.EscapeString(target)
+	case strings.HasPrefix(target, "!"):
+		if label != "" {
+			return html.EscapeString(html.UnescapeString(label))
+		}
+		return "@" + html.EscapeString(strings.TrimPrefix(target, "!"))
+	}
+	if label == "" {
+		label = target
+	}
+	return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(html.UnescapeString(target)), html.EscapeString(html.UnescapeString(label)))
+}
+
+// shouldEmail reports whether a demand should be emailed rather than texted
+func (e *Engine) shouldEmail(text string) bool {
+	if e.mailer == nil {
+		return false
+	}
+	config := e.currentConfig().Email
+	if config.Always {
+		return true
+	}
+	channel := e.twilioClient.DeliveryChannel()
+	return config.AfterChunks > 0 && len(chunkString(text, e.twilioClient.BodyLimit(channel))) > config.AfterChunks
+}
+
+// emailDemand sends a demand to the Dan by email with its files attached and a link back to the
+// slack message. Files that cannot be downloaded are listed instead.
+func (e *Engine) emailDemand(ctx context.Context, demand *Demand) error {
+	ctx, span := trace.StartSpan(ctx, "email.SendDemand")
+	defer span.End()
+
+	text := e.slackWrapper.ReplaceUIDs(demand.Text)
+	var plain, rich strings.Builder
+	if demand.Context != "" {
+		plain.WriteString(demand.Context)
+		rich.WriteString(`<p style="color:#616061">` + strings.Replace(html.EscapeString(demand.Context), "\n", "<br>\n", -1) + "</p>\n")
+	}
+	plain.WriteString(demand.Sender + ": " + text + "\n")
+	rich.WriteString("<p><b>" + html.EscapeString(demand.Sender) + "</b></p>\n<blockquote>" + renderSlackHTML(text) + "</blockquote>\n")
+
+	msg := EmailMessage{
+		To:      e.currentConfig().Email.To,
+		Subject: refCode(demand.ID) + " Demand from " + demand.Sender,
+	}
+	remaining := int64(emailAttachmentLimit)
+	for index := range demand.Files {
+		file := &demand.Files[index]
+		data, err := e.slackWrapper.DownloadFile(ctx, file, remaining)
+		if err != nil {
+			loggerFrom(ctx).WithError(err).WithField("file", file.ID).Warning("failed to attach file to email")
+			plain.WriteString("\n(" + file.Name + " could not be attached)")
+			rich.WriteString("<p><i>" + html.EscapeString(file.Name) + " could not be attached</i></p>\n")
+			continue
+		}
+		remaining -= int64(len(data))
+		msg.Attachments = append(msg.Attachments, EmailAttachment{
+			Name:        file.Name,
+			ContentType: file.Mimetype,
+			Data:        data,
+		})
+	}
+
+	if link, err := e.slackWrapper.Permalink(ctx, demand.Channel, demand.TimeStamp); err != nil {
+		loggerFrom(ctx).WithError(err).Warning("failed to link email to slack")
+	} else {
+		plain.WriteString("\nView in Slack: " + link + "\n")
+		rich.WriteString(`<p><a href="` + html.EscapeString(link) + `">View in Slack</a></p>` + "\n")
+	}
+	if e.webhooksEnabled() {
+		plain.WriteString("\n" + ackUsage + "\n")
+		rich.WriteString("<p>" + html.EscapeString(ackUsage) + "</p>\n")
+	}
+	msg.Text = plain.String()
+	msg.HTML = "<html><body>\n" + rich.String() + "</body></html>\n"
+
+	span.AddAttributes(trace.Int64Attribute("attachments", int64(len(msg.Attachments))))
+	if err := e.mailer.Send(ctx, msg); err != nil {
+		setSpanError(span, err)
+		return errors.Wrap(err, "failed to email demand: ")
+	}
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"attachments": len(msg.Attachments),
+		"size":        len(text),
+	}).Debug("demand emailed")
+	return nil
+}
+
+// emailFollowUp emails text as a reply to an emailed demand
+func (e *Engine) emailFollowUp(ctx context.Context, rec DemandRecord, text string) error {
+	err := e.mailer.Send(ctx, EmailMessage{
+		To:      e.currentConfig().Email.To,
+		Subject: "Re: " + rec.RefCode() + " Demand from " + rec.Sender,
+		Text:    text + "\n",
+		HTML:    "<html><body>\n<p>" + html.EscapeString(text) + "</p>\n</body></html>\n",
+	})
+	return errors.Wrap(err, "failed to email follow-up: ")
+}
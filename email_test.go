@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestRenderSlackHTML(t *testing.T) {
+	cases := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain", "need coffee", "need coffee"},
+		{"escaped", "1 &lt; 2 &amp;&amp; &lt;b&gt;", "1 &lt; 2 &amp;&amp; &lt;b&gt;"},
+		{"formatting", "*now* _please_ ~later~ `make build`", "<b>now</b> <i>please</i> <s>later</s> <code>make build</code>"},
+		{"snake case", "run make_all_the_things", "run make_all_the_things"},
+		{"link", "see <https://example.com/a?b=1&amp;c=2|the docs>", `see <a href="https://example.com/a?b=1&amp;c=2">the docs</a>`},
+		{"bare link", "<https://example.com>", `<a href="https://example.com">https://example.com</a>`},
+		{"mention", "ask <@alice>", "ask @alice"},
+		{"channel", "in <#C00000001|general>", "in #general"},
+		{"special mention", "<!here> fire", "@here fire"},
+		{"newlines", "one\ntwo", "one<br>\ntwo"},
+		{"code block", "run ```*not bold*\n&lt;b&gt;``` ok", "run <pre>*not bold*\n&lt;b&gt;</pre> ok"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := renderSlackHTML(c.text); got != c.want {
+				t.Errorf("expected %q, got %q", c.want, got)
+			}
+		})
+	}
+}
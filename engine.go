@@ -4,11 +4,17 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/nlopes/slack"
 	"github.com/nlopes/slack/slackevents"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/trace"
 )
 
 const (
@@ -16,6 +22,20 @@ const (
 
 	kb                  = 1024
 	twilioFileSizeLimit = 500 * kb
+
+	// demandDedupeWindow is how long we remember a slack message after relaying it
+	demandDedupeWindow = 24 * time.Hour
+	// demandRetention is how long finished demands are kept in the DemandStore
+	demandRetention = 7 * 24 * time.Hour
+
+	// disregardPreviewLength is how much of a recalled demand is quoted in the disregard notice
+	disregardPreviewLength = 80
+
+	// refCodeReserve is the room left in the SMS for the "#D42 " reference code
+	refCodeReserve = 8
+
+	messageChanged = "message_changed"
+	messageDeleted = "message_deleted"
 )
 
 func chunkString(s string, chunkLen int) []string {
@@ -31,15 +51,130 @@ func chunkString(s string, chunkLen int) []string {
 	return chunks
 }
 
+// Demand is a single slack message that is being relayed to the Dan
+type Demand struct {
+	// Channel and TimeStamp identify the slack message the demand originated from
+	Channel     string
+	ChannelType string
+	TimeStamp   string
+
+	// Sender is the attribution prefixed onto the SMS
+	Sender string
+	Text   string
+	Files  []slackevents.File
+
+	// Context is optional text, such as earlier thread messages, sent ahead of the demand
+	Context string
+
+	// Escalate places a voice call to the Dan as soon as the SMS is sent
+	Escalate bool
+	// Via is the channel the demand was delivered over, channelEmail if it was emailed
+	Via string
+
+	// ID is assigned by the DemandStore once the demand is recorded
+	ID int
+}
+
+// Key uniquely identifies the slack message a demand was created from
+func (d *Demand) Key() string {
+	return d.Channel + "/" + d.TimeStamp
+}
+
+// demandFailure annotates an error delivering a demand with a short reason used in metrics
+type demandFailure struct {
+	reason string
+	err    error
+}
+
+func (df *demandFailure) Error() string {
+	return df.err.Error()
+}
+
+// Cause lets errors.Cause see through to the underlying error
+func (df *demandFailure) Cause() error {
+	return df.err
+}
+
+// failureReason returns the metrics reason for a failed demand
+func failureReason(err error) string {
+	if df, ok := err.(*demandFailure); ok {
+		return df.reason
+	}
+	return "unknown"
+}
+
+// channelTypeFromID guesses the channel type of a conversation from its ID prefix for events
+// that do not include it
+func channelTypeFromID(channel string) string {
+	switch {
+	case strings.HasPrefix(channel, "C"):
+		return "channel"
+	case strings.HasPrefix(channel, "G"):
+		return "group"
+	case strings.HasPrefix(channel, "D"):
+		return "im"
+	}
+	return "unknown"
+}
+
 // Engine is the main location for DanDemand application logic. It ties together the API clients,
 // the http server, and the event dispatcher infrastructure
 type Engine struct {
-	config     *DanDemandConfig
+	// settings holds the current *engineSettings, it is swapped as a whole on reload
+	settings   atomic.Value
 	server     *http.Server
 	dispatcher *SlackEventDispatcher
 
 	slackWrapper *SlackWrapper
 	twilioClient *TwilioClient
+
+	deduper *Deduper
+	store   *DemandStore
+	// capture is nil unless slack events are being recorded
+	capture *EventCapture
+	// mailer is nil unless email delivery is configured
+	mailer *Mailer
+
+	// queued is the number of demands currently being sent, accessed atomically
+	queued int64
+	// draining is set to 1 once shutdown has started, accessed atomically
+	draining int32
+
+	slackStatus  dependencyStatus
+	twilioStatus dependencyStatus
+}
+
+// engineSettings is the reloadable configuration of an Engine along with the durations parsed out
+// of it
+type engineSettings struct {
+	config *DanDemandConfig
+
+	editWindow time.Duration
+	// escalateAfter and remindAfter are zero when disabled
+	escalateAfter time.Duration
+	remindAfter   time.Duration
+}
+
+func newEngineSettings(config *DanDemandConfig) (*engineSettings, error) {
+	settings := &engineSettings{config: config}
+	var err error
+	settings.editWindow, err = time.ParseDuration(config.Demand.EditWindow)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse edit_window duration '%s': ", config.Demand.EditWindow)
+	}
+	if config.Escalation.After != "" {
+		settings.escalateAfter, err = time.ParseDuration(config.Escalation.After)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse escalation after duration '%s': ", config.Escalation.After)
+		}
+	}
+	if config.Demand.RemindAfter != "" {
+		settings.remindAfter, err = time.ParseDuration(config.Demand.RemindAfter)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse remind_after duration '%s': ", config.Demand.RemindAfter)
+		}
+	}
+	return settings, nil
 }
 
 func NewEngine(config *DanDemandConfig) (*Engine, error) {
@@ -55,11 +190,39 @@ func NewEngine(config *DanDemandConfig) (*Engine, error) {
 		return nil, errors.Wrap(err, "failed to create TwilioClient: ")
 	}
 
+	settings, err := newEngineSettings(config)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := NewDemandStore(config.Demand.StateFile, demandRetention)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create DemandStore: ")
+	}
+	for from, at := range store.LastInbound() {
+		twilioClient.NoteInbound(from, at)
+	}
+
+	var capture *EventCapture
+	if config.Capture.File != "" {
+		capture, err = NewEventCapture(config.Capture.File, int64(config.Capture.MaxSizeMB)*mb, config.Capture.Backups)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create EventCapture: ")
+		}
+		dispatcher.SetCapture(capture)
+	}
+
+	var mailer *Mailer
+	if config.Email.SMTPAddress != "" {
+		mailer, err = NewMailer(config.Email)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create Mailer: ")
+		}
+	}
+
 	// Configure out mux
 	router := mux.NewRouter()
 	router.Handle("/slack-events", dispatcher)
-	// TODO(rossdylan): Look into adding callbacks for twilio
-	// router.Handle("/twilio-callbacks", twilioClient)
 
 	server := &http.Server{
 		Handler:      &ochttp.Handler{Handler: router},
@@ -69,52 +232,366 @@ func NewEngine(config *DanDemandConfig) (*Engine, error) {
 	}
 
 	engine := &Engine{
-		config:       config,
 		server:       server,
 		dispatcher:   dispatcher,
 		slackWrapper: slackWrapper,
 		twilioClient: twilioClient,
+		deduper:      NewDeduper(demandDedupeWindow),
+		store:        store,
+		capture:      capture,
+		mailer:       mailer,
+	}
+	engine.settings.Store(settings)
+
+	if engine.webhooksEnabled() {
+		router.HandleFunc(voiceGatherPath, engine.HandleVoiceGather).Methods("POST")
+		router.HandleFunc(voiceStatusPath, engine.HandleVoiceStatus).Methods("POST")
+		router.HandleFunc(smsReplyPath, engine.HandleInboundSMS).Methods("POST")
+		router.HandleFunc(smsStatusPath, engine.HandleMessageStatus).Methods("POST")
+		go engine.escalationLoop()
 	}
+	go engine.reminderLoop()
+	go engine.dependencyChecker()
 
-	dispatcher.SetCallbackHandler(slackevents.Message, engine.HandleMessage)
+	dispatcher.AddCallbackHandler(slackevents.Message, "demand", 0, engine.HandleMessage)
+	dispatcher.AddCallbackHandler(slackevents.Message, "demand-updates", 0, engine.HandleMessageUpdate)
+	dispatcher.AddCallbackHandler("reaction_added", "reaction-demand", 0, engine.HandleReactionAdded)
+	dispatcher.AddCallbackHandler("user_change", "user-directory", 0, engine.HandleUserChange)
+	dispatcher.AddCallbackHandler("team_join", "user-directory", 0, engine.HandleUserChange)
 
 	return engine, nil
 }
 
+// currentSettings returns the settings in effect right now
+func (e *Engine) currentSettings() *engineSettings {
+	return e.settings.Load().(*engineSettings)
+}
+
+// currentConfig returns the configuration in effect right now
+func (e *Engine) currentConfig() *DanDemandConfig {
+	return e.currentSettings().config
+}
+
 func (e *Engine) HandleMessage(ctx context.Context, rawEvent interface{}) error {
 	event := rawEvent.(*slackevents.MessageEvent)
 
 	if !(event.ChannelType == "channel" || event.ChannelType == "mim" || event.ChannelType == "group") {
 		return nil
 	}
+	if event.SubType == messageChanged || event.SubType == messageDeleted {
+		return nil
+	}
 	if !strings.Contains(event.Text, e.slackWrapper.BotUID) {
 		return nil
 	}
 
 	name, err := e.slackWrapper.LookupUserName(ctx, event.User)
 	if err != nil {
-		e.slackWrapper.AddReactionBackground("thumbsdown", event.Channel, event.TimeStamp)
+		recordDemand(withDemandTags(ctx, event.ChannelType, e.twilioClient.Recipient()), "failed", "user_lookup")
+		e.slackWrapper.AddReactionBackground(ctx, "thumbsdown", event.Channel, event.TimeStamp)
+		return errors.Wrapf(err, "failed to lookup username for '%s': ", event.User)
+	}
+
+	demand := &Demand{
+		Channel:     event.Channel,
+		ChannelType: event.ChannelType,
+		TimeStamp:   event.TimeStamp,
+		Sender:      name,
+		Text:        event.Text,
+		Files:       event.Files,
+	}
+
+	// The keyword has a default, so without a number to call from it is ignored rather than refused
+	keyword := e.currentConfig().Escalation.Keyword
+	if e.webhooksEnabled() && e.twilioClient.CanCall() && keyword != "" && strings.Contains(demand.Text, keyword) {
+		demand.Text = strings.TrimSpace(strings.Replace(demand.Text, keyword, "", -1))
+		demand.Escalate = true
+	}
+
+	inThread := event.ThreadTimeStamp != "" && event.ThreadTimeStamp != event.TimeStamp
+	if e.currentConfig().Demand.ThreadContext && inThread {
+		messageLen := refCodeReserve + len(demand.Sender+": "+e.slackWrapper.ReplaceUIDs(demand.Text))
+		budget := e.currentConfig().Demand.ThreadSegments*smsSegmentLength - messageLen
+		if channel := e.twilioClient.DeliveryChannel(); channel != channelSMS {
+			// Other channels are not split into segments, the context fits if the whole message does
+			budget = e.twilioClient.BodyLimit(channel) - messageLen
+		}
+		threadText, err := e.threadContext(ctx, event.Channel, event.ThreadTimeStamp, event.TimeStamp, budget)
+		if err != nil {
+			// Context is a nicety, the demand itself is still worth sending
+			loggerFrom(ctx).WithError(err).Warning("failed to build thread context")
+		}
+		demand.Context = threadText
+	}
+
+	return e.sendDemand(ctx, demand)
+}
+
+// HandleUserChange keeps the user directory current as members join, are renamed or deactivated
+func (e *Engine) HandleUserChange(ctx context.Context, rawEvent interface{}) error {
+	switch event := rawEvent.(type) {
+	case *slack.UserChangeEvent:
+		e.slackWrapper.UpdateUser(ctx, event.User)
+	case *slack.TeamJoinEvent:
+		e.slackWrapper.UpdateUser(ctx, event.User)
+	default:
+		return errInvalidCallbackEvent
+	}
+	return nil
+}
+
+// HandleReactionAdded forwards the reacted message as a demand when someone reacts to it with the
+// configured emoji.
+func (e *Engine) HandleReactionAdded(ctx context.Context, rawEvent interface{}) error {
+	event := rawEvent.(*slack.ReactionAddedEvent)
+
+	if e.currentConfig().Slack.ReactionEmoji == "" || event.Reaction != e.currentConfig().Slack.ReactionEmoji {
+		return nil
+	}
+	if event.Item.Type != "message" || event.User == e.slackWrapper.BotUID {
+		return nil
+	}
+
+	reactor, err := e.slackWrapper.LookupUserName(ctx, event.User)
+	if err != nil {
 		return errors.Wrapf(err, "failed to lookup username for '%s': ", event.User)
 	}
 
+	message, err := e.slackWrapper.GetMessage(ctx, event.Item.Channel, event.Item.Timestamp)
+	if err != nil {
+		recordDemand(withDemandTags(ctx, channelTypeFromID(event.Item.Channel), e.twilioClient.Recipient()), "failed", "fetch_message")
+		e.slackWrapper.AddReactionBackground(ctx, "thumbsdown", event.Item.Channel, event.Item.Timestamp)
+		return errors.Wrap(err, "failed to fetch reacted message: ")
+	}
+
+	author := message.Username
+	if message.User != "" {
+		author, err = e.slackWrapper.LookupUserName(ctx, message.User)
+		if err != nil {
+			e.slackWrapper.AddReactionBackground(ctx, "thumbsdown", event.Item.Channel, event.Item.Timestamp)
+			return errors.Wrapf(err, "failed to lookup username for '%s': ", message.User)
+		}
+	}
+
+	files := make([]slackevents.File, 0, len(message.Files))
+	for _, file := range message.Files {
+		files = append(files, eventFileFromSlack(file))
+	}
+
+	return e.sendDemand(ctx, &Demand{
+		Channel:     event.Item.Channel,
+		ChannelType: channelTypeFromID(event.Item.Channel),
+		TimeStamp:   event.Item.Timestamp,
+		Sender:      author + " (via " + reactor + ")",
+		Text:        message.Text,
+		Files:       files,
+	})
+}
+
+// sendDemand relays a demand to the Dan over twilio, chunking it as needed and reacting to the
+// originating slack message with the outcome. Each slack message is only ever relayed once.
+func (e *Engine) sendDemand(ctx context.Context, demand *Demand) error {
+	key := demand.Key()
+	if e.deduper.Seen(key) {
+		loggerFrom(ctx).WithField("key", key).Debug("skipping duplicate demand")
+		return nil
+	}
+
+	ctx, span := trace.StartSpan(ctx, "dan_demand.SendDemand")
+	defer span.End()
+	span.AddAttributes(
+		trace.StringAttribute("demand.key", key),
+		trace.StringAttribute("channel_type", demand.ChannelType),
+		trace.Int64Attribute("files", int64(len(demand.Files))),
+	)
+	ctx = withDemandTags(ctx, demand.ChannelType, e.twilioClient.Recipient())
+	recordDemand(ctx, "received", "")
+	defer e.enqueue()()
+
+	sendCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	demand.ID = e.store.Add(&DemandRecord{
+		Channel:   demand.Channel,
+		TimeStamp: demand.TimeStamp,
+		Sender:    demand.Sender,
+		Text:      demand.Text,
+		Status:    DemandQueued,
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+	})
+	ctx = withLogFields(ctx, logrus.Fields{"demand": refCode(demand.ID)})
+	sendCtx = withLogFields(sendCtx, logrus.Fields{"demand": refCode(demand.ID)})
+	return e.relayDemand(ctx, sendCtx, demand)
+}
+
+// enqueue counts a demand as in flight until the returned func is called
+func (e *Engine) enqueue() func() {
+	stats.Record(context.Background(), mQueueDepth.M(atomic.AddInt64(&e.queued, 1)))
+	return func() {
+		stats.Record(context.Background(), mQueueDepth.M(atomic.AddInt64(&e.queued, -1)))
+	}
+}
+
+// relayDemand delivers a demand that is recorded as queued in the store and records the outcome.
+// sendCtx is cancelled if the demand is deleted while it is being sent.
+func (e *Engine) relayDemand(ctx, sendCtx context.Context, demand *Demand) error {
+	key := demand.Key()
+	if err := e.deliverDemand(sendCtx, demand); err != nil {
+		if rec, ok := e.store.Get(key); ok && rec.Status == DemandCancelled {
+			loggerFrom(ctx).Info("demand was deleted before it could be sent")
+			recordDemand(ctx, "failed", "cancelled")
+			return nil
+		}
+		recordDemand(ctx, "failed", failureReason(err))
+		setSpanError(trace.FromContext(ctx), err)
+		e.store.Update(key, func(rec *DemandRecord) {
+			rec.Status = DemandFailed
+			rec.cancel = nil
+		})
+		e.slackWrapper.AddReactionBackground(ctx, "thumbsdown", demand.Channel, demand.TimeStamp)
+		if twErr, ok := asTwilioError(err); ok {
+			text := "Couldn't text the Dan: " + twErr.Reason() + "."
+			e.slackWrapper.PostThreadReplyBackground(ctx, demand.Channel, demand.TimeStamp, text)
+		}
+		return err
+	}
+	e.store.Update(key, func(rec *DemandRecord) {
+		if rec.Status == DemandQueued {
+			rec.Status = DemandSent
+			rec.SentAt = time.Now()
+		}
+		rec.Via = demand.Via
+		rec.cancel = nil
+	})
+	recordDemand(ctx, "sent", "")
+
+	var emoji string
+	switch {
+	case demand.Via == channelEmail:
+		emoji = "email"
+	case len(demand.Files) > 0:
+		emoji = "foot"
+	default:
+		emoji = "thumbsup"
+	}
+	e.slackWrapper.AddReactionBackground(ctx, emoji, demand.Channel, demand.TimeStamp)
+	if demand.Escalate {
+		go e.escalate(ctx, key)
+	}
+	return nil
+}
+
+// deliverDemand emails the demand if it is configured to, otherwise or if that fails it shares any
+// attached media and sends the demand to twilio
+func (e *Engine) deliverDemand(ctx context.Context, demand *Demand) error {
+	key := demand.Key()
+	baseMessage := refCode(demand.ID) + " " + demand.Context + demand.Sender + ": " + e.slackWrapper.ReplaceUIDs(demand.Text)
+	if e.shouldEmail(baseMessage) {
+		err := e.emailDemand(ctx, demand)
+		if err == nil {
+			demand.Via = channelEmail
+			return nil
+		}
+		if ctx.Err() != nil {
+			e.deduper.Forget(key)
+			return &demandFailure{reason: "email", err: err}
+		}
+		loggerFrom(ctx).WithError(err).Warning("failed to email demand, texting it instead")
+	}
 	var mediaURL *string
-	if len(event.Files) > 0 {
+	if len(demand.Files) > 0 {
 		// TODO(rossdylan): See if we can add multiple files
-		if event.Files[0].IsPublic {
-			url, err := e.slackWrapper.ShareFilePublic(ctx, &event.Files[0])
+		if demand.Files[0].IsPublic {
+			url, err := e.slackWrapper.ShareFilePublic(ctx, &demand.Files[0])
 			if err != nil {
-				e.slackWrapper.AddReactionBackground("thumbsdown", event.Channel, event.TimeStamp)
-				return errors.Wrap(err, "failed to create mms public link: ")
+				e.deduper.Forget(key)
+				return &demandFailure{
+					reason: "media",
+					err:    errors.Wrap(err, "failed to create mms public link: "),
+				}
 			}
 			mediaURL = &url
 		}
 	}
 
-	baseMessage := name + ": " + e.slackWrapper.ReplaceUIDs(event.Text)
-	for index, chunk := range chunkString(baseMessage, twilioMsgLimit) {
+	// Carriers only report filtering and other delivery failures after twilio accepted a message
+	var statusCallback string
+	if e.webhooksEnabled() {
+		statusCallback = e.callbackURL(smsStatusPath, key)
+	}
+	sent, via, err := e.sendChunksOn(ctx, e.twilioClient.DeliveryChannel(), baseMessage, mediaURL, statusCallback)
+	if err != nil {
+		// Only allow a retry if nothing made it out, otherwise the Dan gets duplicate chunks
+		if sent == 0 {
+			e.deduper.Forget(key)
+		}
+		reason := "twilio"
+		if errors.Cause(err) == errRateLimited {
+			reason = "rate_limit"
+		} else if twErr, ok := asTwilioError(err); ok && twErr.Class() != twilioUnknown {
+			reason = "twilio_" + string(twErr.Class())
+		}
+		return &demandFailure{reason: reason, err: err}
+	}
+	demand.Via = via
+	return nil
+}
+
+// sendChunks splits text into as many messages as the recipient's channel needs and sends them in
+// order, attaching the media to the first one. Whatever a WhatsApp or RCS send failed to deliver is
+// sent again as SMS. It returns the number of chunks that were sent successfully. statusCallback,
+// if set, receives the delivery updates of every chunk.
+func (e *Engine) sendChunks(ctx context.Context, text string, mediaURL *string, statusCallback string) (int, error) {
+	sent, _, err := e.sendChunksOn(ctx, e.twilioClient.DeliveryChannel(), text, mediaURL, statusCallback)
+	return sent, err
+}
+
+// sendChunksOn is sendChunks over the given channel, it also returns the channel the last chunk
+// went out on
+func (e *Engine) sendChunksOn(ctx context.Context, channel, text string, mediaURL *string, statusCallback string) (int, string, error) {
+	chunks := chunkString(text, e.twilioClient.BodyLimit(channel))
+	sent, err := e.sendChunksVia(ctx, channel, chunks, mediaURL, statusCallback)
+	if err == nil || channel == channelSMS || errors.Cause(err) == errRateLimited || ctx.Err() != nil {
+		return sent, channel, err
+	}
+
+	loggerFrom(ctx).WithError(err).WithFields(logrus.Fields{
+		"channel": channel,
+		"sent":    sent,
+	}).Warning("failed to deliver over the recipient's channel, falling back to SMS")
+	if sent > 0 {
+		mediaURL = nil
+	}
+	rest := strings.Join(chunks[sent:], "")
+	fallback, err := e.sendChunksVia(ctx, channelSMS, chunkString(rest, twilioMsgLimit), mediaURL, statusCallback)
+	return sent + fallback, channelSMS, err
+}
+
+// sendFollowUp sends text about a demand that was already delivered, like a correction, over the
+// channel the demand went out on so the Dan reads it in the same place
+func (e *Engine) sendFollowUp(ctx context.Context, rec DemandRecord, text string) error {
+	if rec.Via == channelEmail && e.mailer != nil {
+		return e.emailFollowUp(ctx, rec, text)
+	}
+	channel := rec.Via
+	if channel == "" || channel == channelEmail {
+		// Demands recorded before their channel was, or emailed before email was turned off
+		channel = e.twilioClient.DeliveryChannel()
+	}
+	_, _, err := e.sendChunksOn(ctx, channel, text, nil, "")
+	return err
+}
+
+// sendChunksVia sends every chunk over channel, stopping at the first failure
+func (e *Engine) sendChunksVia(ctx context.Context, channel string, chunks []string, mediaURL *string, statusCallback string) (int, error) {
+	var from string
+	for index, chunk := range chunks {
 		params := SendMessageParams{
-			Message: chunk,
-			Chunked: index > 0,
+			Message:        chunk,
+			Chunked:        index > 0,
+			Channel:        channel,
+			From:           from,
+			StatusCallback: statusCallback,
 		}
 
 		// Only attach our media to the first message
@@ -123,21 +600,115 @@ func (e *Engine) HandleMessage(ctx context.Context, rawEvent interface{}) error
 			mediaURL = nil
 		}
 
-		if err := e.twilioClient.SendMessage(ctx, params); err != nil {
-			e.slackWrapper.AddReactionBackground("thumbsdown", event.Channel, event.TimeStamp)
-			return errors.Wrap(err, "failed to send message: ")
+		chunkCtx, span := trace.StartSpan(ctx, "twilio.SendChunk")
+		span.AddAttributes(
+			trace.StringAttribute("channel", channel),
+			trace.Int64Attribute("chunk.index", int64(index)),
+			trace.Int64Attribute("chunk.count", int64(len(chunks))),
+			trace.Int64Attribute("message.size", int64(len(chunk))),
+			trace.BoolAttribute("mms", params.MediaURL != nil),
+		)
+		var err error
+		from, err = e.twilioClient.SendMessage(chunkCtx, params)
+		setSpanError(span, err)
+		span.End()
+		if err != nil {
+			return index, errors.Wrap(err, "failed to send message: ")
 		}
 	}
-	var emoji string
-	if len(event.Files) > 0 {
-		emoji = "foot"
-	} else {
-		emoji = "thumbsup"
+	return len(chunks), nil
+}
+
+// HandleMessageUpdate applies edits and deletions of slack messages to the demands that were
+// created from them.
+func (e *Engine) HandleMessageUpdate(ctx context.Context, rawEvent interface{}) error {
+	event := rawEvent.(*slackevents.MessageEvent)
+
+	switch event.SubType {
+	case messageChanged:
+		return e.handleMessageChanged(ctx, event)
+	case messageDeleted:
+		return e.handleMessageDeleted(ctx, event)
 	}
-	e.slackWrapper.AddReactionBackground(emoji, event.Channel, event.TimeStamp)
+	return nil
+}
+
+// handleMessageChanged sends a correction when a demand that was already sent is edited within
+// the edit window.
+func (e *Engine) handleMessageChanged(ctx context.Context, event *slackevents.MessageEvent) error {
+	if event.Message == nil {
+		return nil
+	}
+	key := event.Channel + "/" + event.Message.TimeStamp
+	rec, ok := e.store.Get(key)
+	if !ok {
+		return nil
+	}
+	// Unfurls and reactions also show up as message_changed, only care about the text
+	if rec.Status != DemandSent || rec.Text == event.Message.Text {
+		return nil
+	}
+	if time.Since(rec.SentAt) > e.currentSettings().editWindow {
+		loggerFrom(ctx).WithField("key", key).Debug("ignoring edit of demand outside of the edit window")
+		return nil
+	}
+
+	correction := "Correction from " + rec.Sender + ": " + e.slackWrapper.ReplaceUIDs(event.Message.Text)
+	if err := e.sendFollowUp(ctx, rec, correction); err != nil {
+		e.slackWrapper.AddReactionBackground(ctx, "thumbsdown", event.Channel, event.Message.TimeStamp)
+		return errors.Wrap(err, "failed to send correction: ")
+	}
+	e.store.Update(key, func(rec *DemandRecord) {
+		rec.Text = event.Message.Text
+	})
+	e.slackWrapper.AddReactionBackground(ctx, "pencil2", event.Channel, event.Message.TimeStamp)
+	return nil
+}
+
+// handleMessageDeleted cancels a demand that is still queued, or asks the Dan to disregard one
+// that was already sent if that is enabled.
+func (e *Engine) handleMessageDeleted(ctx context.Context, event *slackevents.MessageEvent) error {
+	if event.PreviousMessage == nil {
+		return nil
+	}
+	key := event.Channel + "/" + event.PreviousMessage.TimeStamp
+	if e.store.Cancel(key) {
+		loggerFrom(ctx).WithField("key", key).Info("cancelled queued demand")
+		return nil
+	}
+
+	rec, ok := e.store.Get(key)
+	if !ok || rec.Status != DemandSent || !e.currentConfig().Demand.DisregardDeleted {
+		return nil
+	}
+	notice := "Please disregard the demand from " + rec.Sender + ": " +
+		truncate(condense(e.slackWrapper.ReplaceUIDs(rec.Text)), disregardPreviewLength)
+	if err := e.sendFollowUp(ctx, rec, notice); err != nil {
+		return errors.Wrap(err, "failed to send disregard notice: ")
+	}
+	e.store.Update(key, func(rec *DemandRecord) {
+		rec.Status = DemandRecalled
+	})
 	return nil
 }
 
 func (e *Engine) ListenAndServe() error {
-	return errors.Wrap(e.server.ListenAndServe(), "ListenAndServe failed: ")
+	err := e.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return errors.Wrap(err, "ListenAndServe failed: ")
+}
+
+// Shutdown drains the engine and stops the http server once in-flight requests finish
+func (e *Engine) Shutdown(ctx context.Context) error {
+	e.Drain()
+	if err := e.server.Shutdown(ctx); err != nil {
+		return errors.Wrap(err, "Shutdown failed: ")
+	}
+	e.slackWrapper.SaveUsers()
+	if e.capture != nil {
+		return errors.Wrap(e.capture.Close(), "failed to close capture file: ")
+	}
+	return nil
 }
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"dan-demand/slacktest"
+	"dan-demand/smtptest"
+	"dan-demand/twiliotest"
+
+	"github.com/nlopes/slack"
+	"github.com/nlopes/slack/slackevents"
+)
+
+// The engine tests run on the replay env, so they use its credentials
+const (
+	testBotToken          = replayBotToken
+	testAppToken          = replayAppToken
+	testVerificationToken = replayVerificationToken
+	testSigningSecret     = replaySigningSecret
+
+	testBotUID  = "UBOT"
+	testChannel = "C00000001"
+)
+
+// testEnv is an Engine wired up to fake slack and twilio APIs
+type testEnv struct {
+	*replayEnv
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	return newTestEnvWith(t, nil)
+}
+
+// newTestEnvWith lets configure change the config and the fakes before the engine is created
+func newTestEnvWith(t *testing.T, configure func(env *replayEnv, config *DanDemandConfig)) *testEnv {
+	config := newDanDemandConfig()
+	if err := config.apply(defaultsLayer()); err != nil {
+		t.Fatalf("failed to apply defaults: %v", err)
+	}
+	config.Slack.RefreshInterval = "1h"
+	config.Slack.ReactionEmoji = "dan"
+	env, err := newReplayEnv(config, testBotUID, func(env *replayEnv, config *DanDemandConfig) {
+		env.slack.AddUser("U00000001", "alice")
+		env.slack.AddUser("U00000002", "bob")
+		if configure != nil {
+			configure(env, config)
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to create test env: %v", err)
+	}
+	env.engine.twilioClient.retryBackoff = time.Millisecond
+	return &testEnv{env}
+}
+
+// inject delivers an event and fails the test unless it was accepted
+func (env *testEnv) inject(t *testing.T, event interface{}) {
+	resp, err := env.injector.Inject(event)
+	if err != nil {
+		t.Fatalf("failed to inject event: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected event to be accepted, got %s", resp.Status)
+	}
+}
+
+// waitForReaction waits for the bot to react to a message with the given emoji
+func (env *testEnv) waitForReaction(t *testing.T, emoji, channel, ts string) {
+	want := slacktest.Reaction{Name: emoji, Channel: channel, Timestamp: ts}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, reaction := range env.slack.Reactions() {
+			if reaction == want {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s reaction, got %v", emoji, env.slack.Reactions())
+}
+
+// waitForPost waits for the bot to post a message
+func (env *testEnv) waitForPost(t *testing.T, want slacktest.Post) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, post := range env.slack.Posts() {
+			if post == want {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %q to be posted, got %v", want.Text, env.slack.Posts())
+}
+
+func TestMentionIsRelayed(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.inject(t, slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need coffee"))
+
+	messages := env.twilio.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 SMS, got %d", len(messages))
+	}
+	if want := "#D1 alice: <@dan-demand> need coffee"; messages[0].Body != want {
+		t.Errorf("expected SMS %q, got %q", want, messages[0].Body)
+	}
+	if messages[0].To != testToNumber {
+		t.Errorf("expected SMS to %s, got %s", testToNumber, messages[0].To)
+	}
+	env.waitForReaction(t, "thumbsup", testChannel, "1500000000.000100")
+}
+
+func TestUnmentionedMessageIsIgnored(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.inject(t, slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "just chatting"))
+	if messages := env.twilio.Messages(); len(messages) != 0 {
+		t.Fatalf("expected no SMS, got %v", messages)
+	}
+}
+
+func TestRetriedEventIsRelayedOnce(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	event := slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need coffee")
+	eventID := env.injector.NextEventID()
+	for i := 0; i < 2; i++ {
+		resp, err := env.injector.InjectWithID(eventID, event)
+		if err != nil {
+			t.Fatalf("failed to inject event: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if messages := env.twilio.Messages(); len(messages) != 1 {
+		t.Fatalf("expected 1 SMS, got %d", len(messages))
+	}
+}
+
+func TestBadSignatureIsRejected(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.injector.SigningSecret = "not-the-secret"
+	resp, err := env.injector.Inject(slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> hi"))
+	if err != nil {
+		t.Fatalf("failed to inject event: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %s", resp.Status)
+	}
+	if messages := env.twilio.Messages(); len(messages) != 0 {
+		t.Fatalf("expected no SMS, got %v", messages)
+	}
+}
+
+func TestReactionForwardsMessage(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	msg := slack.Message{}
+	msg.Type = "message"
+	msg.User = "U00000001"
+	msg.Text = "the build is on fire"
+	msg.Timestamp = "1500000000.000200"
+	env.slack.AddMessage(testChannel, msg)
+
+	env.inject(t, slacktest.ReactionAddedEvent(testChannel, "U00000002", msg.Timestamp, "dan"))
+
+	messages := env.twilio.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 SMS, got %d", len(messages))
+	}
+	if want := "#D1 alice (via bob): the build is on fire"; messages[0].Body != want {
+		t.Errorf("expected SMS %q, got %q", want, messages[0].Body)
+	}
+	env.waitForReaction(t, "thumbsup", testChannel, msg.Timestamp)
+}
+
+func TestReactionForwardsThreadReply(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	parent := slack.Message{}
+	parent.User = "U00000002"
+	parent.Text = "what's broken?"
+	parent.Timestamp = "1500000000.000100"
+	parent.ThreadTimestamp = parent.Timestamp
+	env.slack.AddMessage(testChannel, parent)
+	reply := slack.Message{}
+	reply.User = "U00000001"
+	reply.Text = "the build is on fire"
+	reply.Timestamp = "1500000000.000200"
+	reply.ThreadTimestamp = parent.Timestamp
+	env.slack.AddMessage(testChannel, reply)
+
+	env.inject(t, slacktest.ReactionAddedEvent(testChannel, "U00000002", reply.Timestamp, "dan"))
+
+	messages := env.twilio.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 SMS, got %d", len(messages))
+	}
+	if want := "#D1 alice (via bob): the build is on fire"; messages[0].Body != want {
+		t.Errorf("expected SMS %q, got %q", want, messages[0].Body)
+	}
+	env.waitForReaction(t, "thumbsup", testChannel, reply.Timestamp)
+}
+
+func TestTwilioFailureIsReported(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.twilio.FailNext(twiliotest.Unsubscribed(testToNumber))
+	resp, err := env.injector.Inject(slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need coffee"))
+	if err != nil {
+		t.Fatalf("failed to inject event: %v", err)
+	}
+	resp.Body.Close()
+
+	env.waitForReaction(t, "thumbsdown", testChannel, "1500000000.000100")
+	rec, ok := env.engine.store.Lookup(1)
+	if !ok {
+		t.Fatal("expected the demand to be recorded")
+	}
+	if rec.Status != DemandFailed {
+		t.Errorf("expected the demand to be failed, got %s", rec.Status)
+	}
+
+	want := slacktest.Post{
+		Channel:  testChannel,
+		Text:     "Couldn't text the Dan: the Dan has unsubscribed from our texts by replying STOP.",
+		ThreadTS: "1500000000.000100",
+	}
+	env.waitForPost(t, want)
+}
+
+func TestUndeliveredDemandIsReported(t *testing.T) {
+	env := newTestEnvWith(t, func(env *replayEnv, config *DanDemandConfig) {
+		config.Server.PublicURL = env.publicURL()
+	})
+	defer env.Close()
+
+	env.inject(t, slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need coffee"))
+	env.waitForReaction(t, "thumbsup", testChannel, "1500000000.000100")
+	messages := env.twilio.Messages()
+	if len(messages) != 1 || messages[0].StatusCallback == "" {
+		t.Fatalf("expected 1 SMS with a status callback, got %v", messages)
+	}
+
+	// The carrier filters the text long after twilio accepted it
+	resp, err := env.twilio.FailDelivery(messages[0].SID, twiliotest.CodeCarrierFiltered)
+	if err != nil {
+		t.Fatalf("failed to fire status callback: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected the status callback to be accepted, got %s", resp.Status)
+	}
+	env.waitForReaction(t, "thumbsdown", testChannel, "1500000000.000100")
+	if rec, _ := env.engine.store.Lookup(1); rec.Status != DemandFailed {
+		t.Errorf("expected the demand to be failed, got %s", rec.Status)
+	}
+	want := slacktest.Post{
+		Channel:  testChannel,
+		Text:     "Couldn't text the Dan: the Dan's carrier filtered the text as spam.",
+		ThreadTS: "1500000000.000100",
+	}
+	env.waitForPost(t, want)
+}
+
+func TestTwilioUnavailableIsRetried(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.twilio.FailNext(twiliotest.ServiceUnavailable())
+	env.inject(t, slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need coffee"))
+	env.waitForReaction(t, "thumbsup", testChannel, "1500000000.000100")
+	if messages := env.twilio.Messages(); len(messages) != 1 {
+		t.Errorf("expected 1 SMS, got %d", len(messages))
+	}
+}
+
+func TestTwilioServerErrorIsNotRetried(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// twilio may have queued the SMS before failing, retrying could text the Dan twice
+	env.twilio.FailNext(twiliotest.ServerError())
+	env.inject(t, slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need coffee"))
+	env.waitForReaction(t, "thumbsdown", testChannel, "1500000000.000100")
+	if messages := env.twilio.Messages(); len(messages) != 0 {
+		t.Errorf("expected no SMS, got %d", len(messages))
+	}
+	env.waitForPost(t, slacktest.Post{
+		Channel:  testChannel,
+		Text:     "Couldn't text the Dan: twilio is having problems.",
+		ThreadTS: "1500000000.000100",
+	})
+}
+
+func TestUserListIsPaged(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	for i := 0; i < 2*userPageSize; i++ {
+		env.slack.AddUser(fmt.Sprintf("U1%08d", i), fmt.Sprintf("user%d", i))
+	}
+	if err := env.engine.slackWrapper.refreshUsers(); err != nil {
+		t.Fatalf("failed to refresh users: %v", err)
+	}
+	if want, got := 2*userPageSize+3, env.engine.slackWrapper.directory.Len(); got != want {
+		t.Errorf("expected %d users, got %d", want, got)
+	}
+}
+
+func TestUserChangeRenamesSender(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.inject(t, slacktest.UserChangeEvent(slack.User{ID: "U00000001", Name: "alicia"}))
+	env.inject(t, slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need coffee"))
+
+	messages := env.twilio.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 SMS, got %d", len(messages))
+	}
+	if want := "#D1 alicia: <@dan-demand> need coffee"; messages[0].Body != want {
+		t.Errorf("expected SMS %q, got %q", want, messages[0].Body)
+	}
+}
+
+func TestUserCacheIsLoadedAtStartup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+
+	// carol left the fake workspace's user list, only the cache knows her name
+	cached := NewUserDirectory()
+	cached.Replace([]slack.User{{ID: "U00000003", Name: "carol"}}, time.Now())
+	if err := cached.Save(path); err != nil {
+		t.Fatalf("failed to save user cache: %v", err)
+	}
+
+	env := newTestEnvWith(t, func(env *replayEnv, config *DanDemandConfig) {
+		config.Slack.UserCacheFile = path
+	})
+	defer env.Close()
+
+	if got := env.engine.slackWrapper.ReplaceUIDs("hi <@U00000003>"); got != "hi <@carol>" {
+		t.Errorf("expected the cached name to be used, got %q", got)
+	}
+	if env.engine.slackWrapper.LastRefresh().IsZero() {
+		t.Errorf("expected the user cache to count as a refresh")
+	}
+}
+
+func TestStaleUserCacheIsRefreshedWhenDue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+
+	// The cache becomes due a refresh shortly after startup, well before another full interval
+	cached := NewUserDirectory()
+	cached.Replace([]slack.User{{ID: "U00000003", Name: "carol"}}, time.Now())
+	cached.lastRefresh = time.Now().Add(-time.Hour + 100*time.Millisecond)
+	if err := cached.Save(path); err != nil {
+		t.Fatalf("failed to save user cache: %v", err)
+	}
+
+	env := newTestEnvWith(t, func(env *replayEnv, config *DanDemandConfig) {
+		config.Slack.UserCacheFile = path
+	})
+	defer env.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if name, ok := env.engine.slackWrapper.directory.Name("U00000001"); ok && name == "alice" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the stale user cache to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRateLimitedReactionIsRetried(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.slack.RateLimitNext("reactions.add", 1)
+	env.inject(t, slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need coffee"))
+	env.waitForReaction(t, "thumbsup", testChannel, "1500000000.000100")
+}
+
+func TestRateLimitLongerThanDeadlineFailsFast(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.slack.RateLimitNext("auth.test", 30)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := env.engine.slackWrapper.AuthTest(ctx); err == nil {
+		t.Fatal("expected the rate limited call to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected to give up right away, waited %v", elapsed)
+	}
+
+	// Other callers of the method wait out the same rate limit instead of hammering slack
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := env.engine.slackWrapper.AuthTest(ctx); err == nil {
+		t.Fatal("expected auth.test to stay blocked for the rate limit")
+	}
+}
+
+// newEmailTestEnv is a test env that emails demands to a fake SMTP server
+func newEmailTestEnv(t *testing.T, configure func(config *EmailConfig)) (*testEnv, *smtptest.Server) {
+	mail, err := smtptest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start smtp server: %v", err)
+	}
+	env := newTestEnvWith(t, func(env *replayEnv, config *DanDemandConfig) {
+		config.Email.SMTPAddress = mail.Addr()
+		config.Email.From = "dan-demand@example.com"
+		config.Email.To = "dan@example.com"
+		configure(config.Email)
+	})
+	return env, mail
+}
+
+func TestLongDemandIsEmailed(t *testing.T) {
+	env, mail := newEmailTestEnv(t, func(config *EmailConfig) {
+		config.AfterChunks = 1
+	})
+	defer mail.Close()
+	defer env.Close()
+
+	file := env.slack.AddFileData(slack.File{ID: "F00000001", Name: "fire.png", Mimetype: "image/png"}, []byte("not really a png"))
+	msg := slack.Message{}
+	msg.Type = "message"
+	msg.User = "U00000001"
+	msg.Text = "the *build* is on fire " + strings.Repeat("again ", twilioMsgLimit/6)
+	msg.Timestamp = "1500000000.000200"
+	msg.Files = []slack.File{file}
+	env.slack.AddMessage(testChannel, msg)
+
+	env.inject(t, slacktest.ReactionAddedEvent(testChannel, "U00000002", msg.Timestamp, "dan"))
+	env.waitForReaction(t, "email", testChannel, msg.Timestamp)
+
+	if messages := env.twilio.Messages(); len(messages) != 0 {
+		t.Errorf("expected no SMS, got %d", len(messages))
+	}
+	emails := mail.Messages()
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(emails))
+	}
+	if want := []string{"dan@example.com"}; !reflect.DeepEqual(emails[0].To, want) {
+		t.Errorf("expected email to %v, got %v", want, emails[0].To)
+	}
+
+	parsed, err := netmail.ReadMessage(bytes.NewReader(emails[0].Data))
+	if err != nil {
+		t.Fatalf("failed to parse email: %v", err)
+	}
+	if want := "#D1 Demand from alice (via bob)"; parsed.Header.Get("Subject") != want {
+		t.Errorf("expected subject %q, got %q", want, parsed.Header.Get("Subject"))
+	}
+	parts := readEmailParts(t, parsed)
+	if !strings.Contains(parts["text/html"], "the <b>build</b> is on fire") {
+		t.Errorf("expected the HTML body to render the message, got %q", parts["text/html"])
+	}
+	if !strings.Contains(parts["text/html"], "/archives/"+testChannel+"/p1500000000000200") {
+		t.Errorf("expected the HTML body to link to the message, got %q", parts["text/html"])
+	}
+	if parts["image/png"] != "not really a png" {
+		t.Errorf("expected the file to be attached, got %q", parts["image/png"])
+	}
+}
+
+func TestCorrectionOfEmailedDemandIsEmailed(t *testing.T) {
+	env, mail := newEmailTestEnv(t, func(config *EmailConfig) {
+		config.Always = true
+	})
+	defer mail.Close()
+	defer env.Close()
+
+	env.inject(t, slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need coffee"))
+	env.waitForReaction(t, "email", testChannel, "1500000000.000100")
+	env.inject(t, slacktest.MessageChangedEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need tea"))
+	env.waitForReaction(t, "pencil2", testChannel, "1500000000.000100")
+
+	if messages := env.twilio.Messages(); len(messages) != 0 {
+		t.Errorf("expected no SMS, got %v", messages)
+	}
+	emails := mail.Messages()
+	if len(emails) != 2 {
+		t.Fatalf("expected the demand and its correction to be emailed, got %d emails", len(emails))
+	}
+	parsed, err := netmail.ReadMessage(bytes.NewReader(emails[1].Data))
+	if err != nil {
+		t.Fatalf("failed to parse email: %v", err)
+	}
+	if want := "Re: #D1 Demand from alice"; parsed.Header.Get("Subject") != want {
+		t.Errorf("expected subject %q, got %q", want, parsed.Header.Get("Subject"))
+	}
+	if parts := readEmailParts(t, parsed); !strings.Contains(parts["text/plain"], "Correction from alice: <@dan-demand> need tea") {
+		t.Errorf("expected the correction in the email, got %q", parts["text/plain"])
+	}
+}
+
+func TestFilesAreOnlyDownloadedFromSlack(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	var leaked string
+	other := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		leaked = req.Header.Get("Authorization")
+	}))
+	defer other.Close()
+
+	file := &slackevents.File{ID: "F00000001", Name: "fire.png", URLPrivateDownload: other.URL + "/files-pri/T00000001-F00000001/fire.png"}
+	if _, err := env.engine.slackWrapper.DownloadFile(context.Background(), file, 1024); err == nil {
+		t.Error("expected a download from outside slack to be refused")
+	}
+	if leaked != "" {
+		t.Errorf("expected the bot token not to be sent, got %q", leaked)
+	}
+
+	for rawURL, want := range map[string]bool{
+		"https://files.slack.com/files-pri/T1-F1/fire.png": true,
+		"https://slack.com/files-pri/T1-F1/fire.png":       true,
+		"http://files.slack.com/files-pri/T1-F1/fire.png":  false,
+		"https://files.slack.com.example.com/fire.png":     false,
+		"https://notslack.com/fire.png":                    false,
+	} {
+		if got := env.engine.slackWrapper.isSlackURL(rawURL); got != want {
+			t.Errorf("isSlackURL(%q) = %v, want %v", rawURL, got, want)
+		}
+	}
+}
+
+func TestFailedEmailFallsBackToSMS(t *testing.T) {
+	env, mail := newEmailTestEnv(t, func(config *EmailConfig) {
+		config.Always = true
+	})
+	defer mail.Close()
+	defer env.Close()
+
+	mail.FailNext()
+	env.inject(t, slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need coffee"))
+	env.waitForReaction(t, "thumbsup", testChannel, "1500000000.000100")
+	if messages := env.twilio.Messages(); len(messages) != 1 {
+		t.Errorf("expected 1 SMS, got %d", len(messages))
+	}
+	if emails := mail.Messages(); len(emails) != 0 {
+		t.Errorf("expected no email, got %d", len(emails))
+	}
+}
+
+// readEmailParts returns the decoded body of every leaf part of a multipart email by content type
+func readEmailParts(t *testing.T, msg *netmail.Message) map[string]string {
+	parts := make(map[string]string)
+	var walk func(contentType string, header textproto.MIMEHeader, body io.Reader)
+	walk = func(contentType string, header textproto.MIMEHeader, body io.Reader) {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			t.Fatalf("failed to parse content type %q: %v", contentType, err)
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			reader := multipart.NewReader(body, params["boundary"])
+			for {
+				part, err := reader.NextPart()
+				if err == io.EOF {
+					return
+				} else if err != nil {
+					t.Fatalf("failed to read email part: %v", err)
+				}
+				walk(part.Header.Get("Content-Type"), part.Header, part)
+			}
+		}
+		if header.Get("Content-Transfer-Encoding") == "base64" {
+			body = base64.NewDecoder(base64.StdEncoding, body)
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatalf("failed to read %s part: %v", mediaType, err)
+		}
+		parts[mediaType] = string(data)
+	}
+	walk(msg.Header.Get("Content-Type"), textproto.MIMEHeader(msg.Header), msg.Body)
+	return parts
+}
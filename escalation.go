@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	voiceGatherPath = "/twilio/voice/gather"
+	voiceStatusPath = "/twilio/voice/status"
+
+	// escalationCheckInterval is how often we look for demands that need a call
+	escalationCheckInterval = 30 * time.Second
+	escalationCallTimeout   = 10 * time.Second
+	// escalationWindow bounds how old, in multiples of escalation.after, a demand may be and still
+	// get a call
+	escalationWindow = 2
+
+	// twilioSayLimit is the maximum number of characters twilio will read in a single <Say>
+	twilioSayLimit = 4096
+	ackDigit       = "1"
+)
+
+// webhooksEnabled reports whether twilio is able to reach us, which is needed for voice call
+// escalation and SMS acknowledgements
+func (e *Engine) webhooksEnabled() bool {
+	return e.currentConfig().Server.PublicURL != ""
+}
+
+// callbackURL builds the public URL twilio should use to reach the given path for a demand
+func (e *Engine) callbackURL(path, key string) string {
+	base := strings.TrimRight(e.currentConfig().Server.PublicURL, "/")
+	return base + path + "?" + url.Values{"demand": {key}}.Encode()
+}
+
+// writeSay appends a <Say> verb for text to buf, escaping it for XML
+func writeSay(buf *bytes.Buffer, voice, text string) {
+	buf.WriteString("<Say")
+	if voice != "" {
+		buf.WriteString(` voice="`)
+		xml.EscapeText(buf, []byte(voice))
+		buf.WriteString(`"`)
+	}
+	buf.WriteString(">")
+	xml.EscapeText(buf, []byte(text))
+	buf.WriteString("</Say>")
+}
+
+// escalationTwiML reads the demand aloud and waits for the Dan to press 1 to acknowledge it
+func escalationTwiML(text, gatherURL, voice string) string {
+	var buf bytes.Buffer
+	buf.WriteString("<Response>")
+	buf.WriteString(`<Gather numDigits="1" method="POST" action="`)
+	xml.EscapeText(&buf, []byte(gatherURL))
+	buf.WriteString(`">`)
+	writeSay(&buf, voice, truncate(text, twilioSayLimit))
+	writeSay(&buf, voice, "Press "+ackDigit+" to acknowledge this demand.")
+	buf.WriteString("</Gather>")
+	writeSay(&buf, voice, "No acknowledgement received. Goodbye.")
+	buf.WriteString("</Response>")
+	return buf.String()
+}
+
+// escalate places a voice call to the Dan for the given demand and reports it in the slack thread.
+// Each demand is escalated at most once.
+func (e *Engine) escalate(ctx context.Context, key string) {
+	var rec DemandRecord
+	var first bool
+	e.store.Update(key, func(r *DemandRecord) {
+		first = !r.Escalated
+		r.Escalated = true
+		rec = *r
+	})
+	if !first {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(detachContext(ctx), escalationCallTimeout)
+	defer cancel()
+	text := "Demand from " + rec.Sender + ": " + condense(e.slackWrapper.ReplaceUIDs(rec.Text))
+	sid, err := e.twilioClient.PlaceCall(ctx, PlaceCallParams{
+		TwiML:          escalationTwiML(text, e.callbackURL(voiceGatherPath, key), e.currentConfig().Escalation.Voice),
+		StatusCallback: e.callbackURL(voiceStatusPath, key),
+	})
+	if err != nil {
+		loggerFrom(ctx).WithError(err).WithField("demand", rec.RefCode()).Error("failed to escalate demand")
+		e.slackWrapper.PostThreadReplyBackground(ctx, rec.Channel, rec.TimeStamp, "Failed to call the Dan about this demand.")
+		return
+	}
+	e.store.Update(key, func(r *DemandRecord) {
+		r.CallSID = sid
+	})
+	e.slackWrapper.PostThreadReplyBackground(ctx, rec.Channel, rec.TimeStamp, "Calling the Dan about this demand.")
+}
+
+// escalationLoop periodically calls the Dan about sent demands that have not been acknowledged
+// within the configured time. Calls are placed concurrently so a slow one does not hold up the rest.
+func (e *Engine) escalationLoop() {
+	ticker := time.NewTicker(escalationCheckInterval)
+	for range ticker.C {
+		loopHeartbeats.Beat("escalation", escalationCheckInterval)
+		after := e.currentSettings().escalateAfter
+		if after == 0 {
+			continue
+		}
+		for _, rec := range e.store.List() {
+			if !rec.Open() || rec.Escalated || !rec.AcknowledgedAt.IsZero() {
+				continue
+			}
+			// Demands that went unanswered for much longer, e.g. while we were down, are stale
+			// and not worth waking anyone up for
+			if age := time.Since(rec.SentAt); age > after && age <= escalationWindow*after {
+				go e.escalate(context.Background(), rec.Key())
+			}
+		}
+	}
+}
+
+// verifyTwilioRequest parses the webhook form and checks that it was signed by twilio. The
+// returned context logs with the message or call SID of the webhook as its correlation ID.
+func (e *Engine) verifyTwilioRequest(req *http.Request) (context.Context, bool) {
+	ctx := req.Context()
+	if err := req.ParseForm(); err != nil {
+		loggerFrom(ctx).WithError(err).Error("failed to parse twilio webhook")
+		return ctx, false
+	}
+	if sid := req.PostForm.Get("MessageSid"); sid != "" {
+		ctx = withCorrelationID(ctx, sid)
+	} else if sid := req.PostForm.Get("CallSid"); sid != "" {
+		ctx = withCorrelationID(ctx, sid)
+	}
+	fullURL := strings.TrimRight(e.currentConfig().Server.PublicURL, "/") + req.URL.RequestURI()
+	if !e.twilioClient.ValidateSignature(req, fullURL) {
+		loggerFrom(ctx).WithField("path", req.URL.Path).Warning("rejected twilio webhook with an invalid signature")
+		return ctx, false
+	}
+	return ctx, true
+}
+
+// writeTwiML responds to a twilio webhook with a TwiML document
+func writeTwiML(resp http.ResponseWriter, twiml string) {
+	resp.Header().Set("Content-Type", "text/xml")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write([]byte(twiml))
+}
+
+// HandleVoiceGather receives the digits the Dan pressed during an escalation call
+func (e *Engine) HandleVoiceGather(resp http.ResponseWriter, req *http.Request) {
+	ctx, ok := e.verifyTwilioRequest(req)
+	if !ok {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := req.URL.Query().Get("demand")
+	var buf bytes.Buffer
+	buf.WriteString("<Response>")
+	if req.PostForm.Get("Digits") != ackDigit {
+		writeSay(&buf, e.currentConfig().Escalation.Voice, "Demand not acknowledged. Goodbye.")
+		buf.WriteString("</Response>")
+		writeTwiML(resp, buf.String())
+		return
+	}
+
+	var rec DemandRecord
+	found := e.store.Update(key, func(r *DemandRecord) {
+		r.AcknowledgedAt = time.Now()
+		rec = *r
+	})
+	if found {
+		e.slackWrapper.PostThreadReplyBackground(ctx, rec.Channel, rec.TimeStamp, "The Dan acknowledged this demand by phone.")
+		e.slackWrapper.AddReactionBackground(ctx, "telephone_receiver", rec.Channel, rec.TimeStamp)
+	}
+	writeSay(&buf, e.currentConfig().Escalation.Voice, "Demand acknowledged. Goodbye.")
+	buf.WriteString("</Response>")
+	writeTwiML(resp, buf.String())
+}
+
+// HandleVoiceStatus receives the final status of an escalation call and reports calls that did not
+// end with an acknowledgement back to slack
+func (e *Engine) HandleVoiceStatus(resp http.ResponseWriter, req *http.Request) {
+	ctx, ok := e.verifyTwilioRequest(req)
+	if !ok {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+
+	rec, ok := e.store.Get(req.URL.Query().Get("demand"))
+	if !ok || !rec.AcknowledgedAt.IsZero() {
+		return
+	}
+	status := req.PostForm.Get("CallStatus")
+	var text string
+	switch status {
+	case "completed":
+		text = "The Dan answered the call but did not acknowledge this demand."
+	case "busy", "no-answer", "failed", "canceled":
+		text = "Call to the Dan about this demand ended: " + status + "."
+	default:
+		return
+	}
+	e.slackWrapper.PostThreadReplyBackground(ctx, rec.Channel, rec.TimeStamp, text)
+}
@@ -3,8 +3,9 @@ module dan-demand
 go 1.12
 
 require (
+	contrib.go.opencensus.io/exporter/jaeger v0.1.0
+	contrib.go.opencensus.io/exporter/ocagent v0.5.0
 	contrib.go.opencensus.io/exporter/prometheus v0.1.0
-	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/gorilla/mux v1.7.2
 	github.com/gorilla/websocket v1.4.0 // indirect
 	github.com/lusis/go-slackbot v0.0.0-20180109053408-401027ccfef5 // indirect
@@ -12,6 +13,7 @@ require (
 	github.com/nlopes/slack v0.5.0
 	github.com/pelletier/go-toml v1.4.0
 	github.com/pkg/errors v0.8.1
+	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.3.0 // indirect
 	go.opencensus.io v0.22.0
 	golang.org/x/net v0.0.0-20190522155817-f3200d17e092
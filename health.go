@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dependencyCheckInterval is how often slack and twilio credentials are re-checked
+	dependencyCheckInterval = time.Minute
+	dependencyCheckTimeout  = 10 * time.Second
+	// dependencyCheckMaxAge is how old the last successful dependency check may be before we
+	// report not ready
+	dependencyCheckMaxAge = 3 * dependencyCheckInterval
+
+	// heartbeatTolerance is how many intervals a background loop may miss before it is considered
+	// stuck
+	heartbeatTolerance = 3
+
+	// saturatedQueueDepth is the number of in-flight demands at which we stop reporting ready
+	saturatedQueueDepth = 10
+)
+
+// loopHeartbeats tracks every long running background goroutine
+var loopHeartbeats = NewHeartbeats()
+
+// Heartbeats records when each background loop last made progress so liveness checks can spot
+// loops that died or are stuck.
+type Heartbeats struct {
+	lock  sync.Mutex
+	beats map[string]heartbeat
+}
+
+type heartbeat struct {
+	last     time.Time
+	interval time.Duration
+}
+
+func NewHeartbeats() *Heartbeats {
+	return &Heartbeats{beats: make(map[string]heartbeat)}
+}
+
+// Beat marks the named loop as alive, it is expected to beat again within interval
+func (hb *Heartbeats) Beat(name string, interval time.Duration) {
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	hb.beats[name] = heartbeat{last: time.Now(), interval: interval}
+}
+
+// Check reports every loop and whether it has beaten recently enough
+func (hb *Heartbeats) Check() map[string]checkResult {
+	hb.lock.Lock()
+	defer hb.lock.Unlock()
+	results := make(map[string]checkResult, len(hb.beats))
+	for name, beat := range hb.beats {
+		age := time.Since(beat.last)
+		results[name] = checkResult{
+			OK:     age <= heartbeatTolerance*beat.interval,
+			Detail: fmt.Sprintf("last beat %v ago", age.Truncate(time.Second)),
+		}
+	}
+	return results
+}
+
+// checkResult is the outcome of a single health check
+type checkResult struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// dependencyStatus remembers the outcome of the last check of an external dependency
+type dependencyStatus struct {
+	lock        sync.Mutex
+	lastChecked time.Time
+	lastOK      time.Time
+	lastErr     error
+}
+
+func (ds *dependencyStatus) record(err error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	ds.lastChecked = time.Now()
+	ds.lastErr = err
+	if err == nil {
+		ds.lastOK = ds.lastChecked
+	}
+}
+
+func (ds *dependencyStatus) check() checkResult {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	switch {
+	case ds.lastChecked.IsZero():
+		return checkResult{Detail: "not checked yet"}
+	case ds.lastErr != nil:
+		return checkResult{Detail: ds.lastErr.Error()}
+	case time.Since(ds.lastOK) > dependencyCheckMaxAge:
+		return checkResult{Detail: fmt.Sprintf("last success %v ago", time.Since(ds.lastOK).Truncate(time.Second))}
+	}
+	return checkResult{OK: true, Detail: fmt.Sprintf("last success %v ago", time.Since(ds.lastOK).Truncate(time.Second))}
+}
+
+// dependencyChecker periodically verifies our slack and twilio credentials
+func (e *Engine) dependencyChecker() {
+	check := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dependencyCheckTimeout)
+		defer cancel()
+		slackErr := e.slackWrapper.AuthTest(ctx)
+		if slackErr != nil {
+			logger.WithError(slackErr).Error("slack dependency check failed")
+		}
+		e.slackStatus.record(slackErr)
+		twilioErr := e.twilioClient.CheckAccount(ctx)
+		if twilioErr != nil {
+			logger.WithError(twilioErr).Error("twilio dependency check failed")
+		}
+		e.twilioStatus.record(twilioErr)
+	}
+
+	ticker := time.NewTicker(dependencyCheckInterval)
+	for {
+		loopHeartbeats.Beat("dependency-checker", dependencyCheckInterval)
+		check()
+		<-ticker.C
+	}
+}
+
+// Drain marks the engine as shutting down so readiness checks fail and load balancers stop
+// sending us traffic
+func (e *Engine) Drain() {
+	atomic.StoreInt32(&e.draining, 1)
+}
+
+// writeHealthReport writes every check as JSON, responding with 503 if any of them failed
+func writeHealthReport(resp http.ResponseWriter, checks map[string]checkResult) {
+	status, code := "ok", http.StatusOK
+	for _, result := range checks {
+		if !result.OK {
+			status, code = "fail", http.StatusServiceUnavailable
+			break
+		}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(code)
+	encoder := json.NewEncoder(resp)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(struct {
+		Status string                 `json:"status"`
+		Checks map[string]checkResult `json:"checks"`
+	}{status, checks})
+	if err != nil {
+		logger.WithError(err).Error("failed to encode health report")
+	}
+}
+
+// HandleHealthz reports whether every background loop is still running
+func (e *Engine) HandleHealthz(resp http.ResponseWriter, req *http.Request) {
+	writeHealthReport(resp, loopHeartbeats.Check())
+}
+
+// HandleReadyz reports whether we are able to relay demands right now
+func (e *Engine) HandleReadyz(resp http.ResponseWriter, req *http.Request) {
+	checks := make(map[string]checkResult)
+
+	if lastRefresh := e.slackWrapper.LastRefresh(); lastRefresh.IsZero() {
+		checks["user_cache"] = checkResult{Detail: "user list not loaded yet"}
+	} else {
+		checks["user_cache"] = checkResult{OK: true, Detail: fmt.Sprintf("refreshed %v ago", time.Since(lastRefresh).Truncate(time.Second))}
+	}
+
+	checks["slack"] = e.slackStatus.check()
+	checks["twilio"] = e.twilioStatus.check()
+
+	depth := atomic.LoadInt64(&e.queued)
+	checks["queue"] = checkResult{
+		OK:     depth < saturatedQueueDepth,
+		Detail: fmt.Sprintf("%d of %d demands in flight", depth, saturatedQueueDepth),
+	}
+
+	if atomic.LoadInt32(&e.draining) == 1 {
+		checks["draining"] = checkResult{Detail: "shutting down"}
+	} else {
+		checks["draining"] = checkResult{OK: true}
+	}
+	writeHealthReport(resp, checks)
+}
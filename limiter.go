@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"sync"
 	"time"
 )
 
 // Limiter is a super simple throttle structure based on the one in the golang wiki. Its wrapped
 // up to make it a little more ergonomic
 type Limiter struct {
-	limit    time.Duration
+	limitLock sync.RWMutex
+	limit     time.Duration
+
 	throttle chan struct{}
+	update   chan time.Duration
 	cancel   context.CancelFunc
 }
 
@@ -18,12 +22,25 @@ func (l *Limiter) Stop() {
 }
 
 func (l *Limiter) driver(ctx context.Context) {
-	ticker := time.NewTicker(l.limit)
-	defer ticker.Stop()
+	ticker := time.NewTicker(l.Limit())
+	// The ticker is replaced when the limit changes, so stop whichever one is current
+	defer func() {
+		ticker.Stop()
+	}()
 	for {
 		select {
 		case <-ticker.C:
-			l.throttle <- struct{}{}
+			select {
+			case l.throttle <- struct{}{}:
+			case limit := <-l.update:
+				ticker.Stop()
+				ticker = time.NewTicker(limit)
+			case <-ctx.Done():
+				return
+			}
+		case limit := <-l.update:
+			ticker.Stop()
+			ticker = time.NewTicker(limit)
 		case <-ctx.Done():
 			return
 		}
@@ -35,12 +52,37 @@ func NewLimiter(limit time.Duration) *Limiter {
 	lim := &Limiter{
 		limit:    limit,
 		throttle: make(chan struct{}),
+		update:   make(chan time.Duration, 1),
 		cancel:   cancel,
 	}
 	go lim.driver(ctx)
 	return lim
 }
 
+// Limit returns the current interval between acquisitions
+func (l *Limiter) Limit() time.Duration {
+	l.limitLock.RLock()
+	defer l.limitLock.RUnlock()
+	return l.limit
+}
+
+// SetLimit changes the interval between acquisitions without dropping anyone waiting to acquire
+func (l *Limiter) SetLimit(limit time.Duration) {
+	l.limitLock.Lock()
+	defer l.limitLock.Unlock()
+	if l.limit == limit {
+		return
+	}
+	l.limit = limit
+	// Replace any update the driver has not picked up yet, so this never blocks, even once the
+	// driver was stopped
+	select {
+	case <-l.update:
+	default:
+	}
+	l.update <- limit
+}
+
 func (l *Limiter) Acquire(ctx context.Context) bool {
 	select {
 	case <-l.throttle:
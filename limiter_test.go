@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSetLimitAfterStop(t *testing.T) {
+	limiter := NewLimiter(time.Hour)
+	limiter.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		limiter.SetLimit(time.Minute)
+		limiter.SetLimit(time.Second)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetLimit blocked on a stopped limiter")
+	}
+	if limit := limiter.Limit(); limit != time.Second {
+		t.Errorf("expected a limit of 1s, got %v", limit)
+	}
+}
+
+func TestSetLimitAppliesToWaiters(t *testing.T) {
+	limiter := NewLimiter(time.Hour)
+	defer limiter.Stop()
+
+	limiter.SetLimit(time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !limiter.Acquire(ctx) {
+		t.Fatal("expected the new limit to apply")
+	}
+}
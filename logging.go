@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+
+	// correlationIDField ties together every log line caused by the same slack event or webhook
+	correlationIDField = "correlation_id"
+)
+
+var (
+	// logger is the process wide logger, it is configured from the [logging] section
+	logger = logrus.New()
+	// logRedactor scrubs secrets from everything written by logger
+	logRedactor = &redactingFormatter{formatter: &logrus.TextFormatter{FullTimestamp: true, DisableColors: true}}
+
+	// phonePattern matches E.164 phone numbers, including URL encoded ones in twilio responses
+	phonePattern = regexp.MustCompile(`(\+|%2B)[1-9][0-9]{6,14}`)
+	// slackTokenPattern matches every kind of slack token
+	slackTokenPattern = regexp.MustCompile(`\b(xox[abposr]|xapp)-[A-Za-z0-9-]+`)
+)
+
+func init() {
+	logger.SetOutput(os.Stderr)
+	logger.SetFormatter(logRedactor)
+}
+
+// redactingFormatter removes phone numbers, slack tokens and configured secrets from log entries
+// before handing them to the real formatter
+type redactingFormatter struct {
+	lock      sync.RWMutex
+	formatter logrus.Formatter
+	secrets   []string
+}
+
+// configure swaps the underlying formatter and the list of secrets to scrub
+func (rf *redactingFormatter) configure(formatter logrus.Formatter, secrets []string) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	rf.formatter = formatter
+	rf.secrets = secrets
+}
+
+// redact masks everything sensitive in text. Phone numbers keep their last 4 digits so on-call can
+// still tell them apart.
+func (rf *redactingFormatter) redact(text string) string {
+	for _, secret := range rf.secrets {
+		text = strings.Replace(text, secret, redactedValue, -1)
+	}
+	text = slackTokenPattern.ReplaceAllString(text, "$1-"+redactedValue)
+	return phonePattern.ReplaceAllStringFunc(text, func(number string) string {
+		return "+***" + number[len(number)-4:]
+	})
+}
+
+func (rf *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	rf.lock.RLock()
+	defer rf.lock.RUnlock()
+
+	redacted := *entry
+	redacted.Message = rf.redact(entry.Message)
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch val := value.(type) {
+		case string:
+			redacted.Data[key] = rf.redact(val)
+		case error:
+			redacted.Data[key] = rf.redact(val.Error())
+		default:
+			redacted.Data[key] = value
+		}
+	}
+	return rf.formatter.Format(&redacted)
+}
+
+// setupLogging applies the [logging] section and registers every configured secret for redaction.
+// It is safe to call again when the config is reloaded.
+func setupLogging(config *DanDemandConfig) error {
+	var formatter logrus.Formatter
+	switch config.Logging.Format {
+	case logFormatLogfmt:
+		formatter = &logrus.TextFormatter{FullTimestamp: true, DisableColors: true}
+	case logFormatJSON:
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return errors.Errorf("unknown log format %q", config.Logging.Format)
+	}
+	level, err := logrus.ParseLevel(config.Logging.Level)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse log level: ")
+	}
+
+	var secrets []string
+	for key, value := range config.Redacted() {
+		if value == redactedValue {
+			secrets = append(secrets, config.fields()[key].value.String())
+		}
+	}
+	logRedactor.configure(formatter, secrets)
+	logger.SetLevel(level)
+	return nil
+}
+
+type logContextKey struct{}
+
+// withLogFields returns a context whose logger includes the given fields
+func withLogFields(ctx context.Context, fields logrus.Fields) context.Context {
+	return context.WithValue(ctx, logContextKey{}, loggerFrom(ctx).WithFields(fields))
+}
+
+// withCorrelationID returns a context whose logger tags every line with the correlation ID
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return withLogFields(ctx, logrus.Fields{correlationIDField: id})
+}
+
+// loggerFrom returns the logger carried by ctx, or the process wide logger
+func loggerFrom(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(logContextKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(logger)
+}
+
+// detachContext returns a background context that keeps the logger of ctx, for work that outlives
+// the request that started it
+func detachContext(ctx context.Context) context.Context {
+	return context.WithValue(context.Background(), logContextKey{}, loggerFrom(ctx))
+}
@@ -1,38 +1,103 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
-
-	"github.com/golang/glog"
-	"github.com/pkg/errors"
 )
 
 const (
 	slackEventTimeout = 3 * time.Second
+	// drainTimeout is how long we keep serving in-flight requests after being asked to stop
+	drainTimeout = 10 * time.Second
+	// readinessGracePeriod is how long we report not ready before we stop accepting requests, so
+	// load balancers stop routing to us first
+	readinessGracePeriod = 5 * time.Second
 )
 
 var (
-	flagConfigPath = flag.String("dan-demand.config", "", "Configuration file location")
+	flagConfigPath  = flag.String("dan-demand.config", "", "Configuration file location")
+	flagCheckConfig = flag.Bool("check-config", false, "Validate the configuration and exit")
+	flagOverrides   stringsFlag
 )
 
+func init() {
+	flag.Var(&flagOverrides, "dan-demand.set", "Override a setting as section.key=value, may be repeated")
+}
+
 func main() {
 	flag.Parse()
 
-	config, err := LoadConfig(*flagConfigPath)
+	config, err := LoadConfig(*flagConfigPath, flagOverrides)
 	if err != nil {
-		glog.Fatal(errors.Wrap(err, "failed to load config: "))
+		logger.WithError(err).Fatal("failed to load config")
+	}
+
+	// Replay brings its own fake providers so it does not need a complete config
+	if flag.Arg(0) == replayCommand {
+		if err := runReplay(config, flag.Args()[1:]); err != nil {
+			logger.WithError(err).Fatal("replay failed")
+		}
+		return
+	}
+
+	if err := config.Validate(); err != nil {
+		if *flagCheckConfig {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		logger.WithError(err).Fatal("invalid configuration")
+	}
+	if *flagCheckConfig {
+		fmt.Println("configuration is valid")
+		return
 	}
 
+	if err := setupLogging(config); err != nil {
+		logger.WithError(err).Fatal("failed to setup logging")
+	}
+
+	stopTracing, err := setupTracing(config.Tracing)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to setup tracing")
+	}
+	defer stopTracing()
+
 	engine, err := NewEngine(config)
 	if err != nil {
-		glog.Fatal(errors.Wrap(err, "failed to create Engine: "))
+		logger.WithError(err).Fatal("failed to create Engine")
 	}
 
-	glog.Infof("DanDemand running on %s", config.Server.Address)
-	err = startZPages(config.Server.ZPagesAddress)
+	go NewConfigReloader(*flagConfigPath, flagOverrides, engine).Run()
+
+	logger.WithField("address", config.Server.Address).Info("DanDemand running")
+	err = startZPages(config.Server.ZPagesAddress, engine)
 	if err != nil {
-		glog.Fatal(errors.Wrap(err, "failed to start zpages: "))
+		logger.WithError(err).Fatal("failed to start zpages")
+	}
+	// done is closed once Shutdown returned, ListenAndServe returns as soon as it is called
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-stop
+		logger.WithField("signal", sig.String()).Info("draining")
+		engine.Drain()
+		time.Sleep(readinessGracePeriod)
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := engine.Shutdown(ctx); err != nil {
+			logger.WithError(err).Error("failed to drain")
+		}
+	}()
+	if err := engine.ListenAndServe(); err != nil {
+		logger.WithError(err).Fatal("server failed")
 	}
-	glog.Fatal(engine.ListenAndServe())
+	<-done
+	logger.Info("DanDemand stopped")
 }
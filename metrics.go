@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	keyResult      = tag.MustNewKey("result")
+	keyStatus      = tag.MustNewKey("status")
+	keyReason      = tag.MustNewKey("reason")
+	keyChannelType = tag.MustNewKey("channel_type")
+	keyRecipient   = tag.MustNewKey("recipient")
+	keyEndpoint    = tag.MustNewKey("endpoint")
+	keyStatusCode  = tag.MustNewKey("status_code")
+	keyMethod      = tag.MustNewKey("method")
+)
+
+var (
+	mConfigReloads       = stats.Int64("dan_demand/config_reloads", "Number of configuration reload attempts", stats.UnitDimensionless)
+	mDemands             = stats.Int64("dan_demand/demands", "Number of demands by status", stats.UnitDimensionless)
+	mSMSSegments         = stats.Int64("dan_demand/sms_segments", "Number of SMS segments twilio reported sending", stats.UnitDimensionless)
+	mMediaBytes          = stats.Int64("dan_demand/mms_media_bytes", "Size of media attached to MMS", stats.UnitBytes)
+	mLimiterWait         = stats.Float64("dan_demand/limiter_wait", "Time spent waiting on the rate limiter", stats.UnitMilliseconds)
+	mTwilioLatency       = stats.Float64("dan_demand/twilio_latency", "Latency of twilio API requests", stats.UnitMilliseconds)
+	mSlackLatency        = stats.Float64("dan_demand/slack_latency", "Latency of slack API requests", stats.UnitMilliseconds)
+	mSlackThrottleWait   = stats.Float64("dan_demand/slack_throttle_wait", "Time spent waiting out slack rate limits", stats.UnitMilliseconds)
+	mUserCacheSize       = stats.Int64("dan_demand/user_cache_size", "Number of users in the user cache", stats.UnitDimensionless)
+	mUserRefreshDuration = stats.Float64("dan_demand/user_refresh_duration", "Time taken to refresh the user cache", stats.UnitMilliseconds)
+	mQueueDepth          = stats.Int64("dan_demand/queue_depth", "Number of demands waiting to be sent", stats.UnitDimensionless)
+)
+
+// latencyDistribution is shared by every latency view, in milliseconds
+var latencyDistribution = view.Distribution(5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000)
+
+// appViews are the DanDemand specific views exported alongside the ochttp views
+var appViews = []*view.View{
+	{
+		Name:        "dan_demand/config_reloads",
+		Description: "Count of configuration reloads by result",
+		Measure:     mConfigReloads,
+		TagKeys:     []tag.Key{keyResult},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "dan_demand/demands",
+		Description: "Count of demands received, sent and failed",
+		Measure:     mDemands,
+		TagKeys:     []tag.Key{keyStatus, keyReason, keyChannelType, keyRecipient},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "dan_demand/sms_segments",
+		Description: "Total SMS segments sent",
+		Measure:     mSMSSegments,
+		TagKeys:     []tag.Key{keyChannelType, keyRecipient},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "dan_demand/mms_media_bytes",
+		Description: "Total bytes of media attached to MMS",
+		Measure:     mMediaBytes,
+		TagKeys:     []tag.Key{keyChannelType, keyRecipient},
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "dan_demand/limiter_wait",
+		Description: "Distribution of time spent waiting on the rate limiter",
+		Measure:     mLimiterWait,
+		TagKeys:     []tag.Key{keyRecipient},
+		Aggregation: latencyDistribution,
+	},
+	{
+		Name:        "dan_demand/twilio_latency",
+		Description: "Distribution of twilio API latency by endpoint and status code",
+		Measure:     mTwilioLatency,
+		TagKeys:     []tag.Key{keyEndpoint, keyStatusCode},
+		Aggregation: latencyDistribution,
+	},
+	{
+		Name:        "dan_demand/twilio_requests",
+		Description: "Count of twilio API requests by endpoint and status code",
+		Measure:     mTwilioLatency,
+		TagKeys:     []tag.Key{keyEndpoint, keyStatusCode},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "dan_demand/slack_latency",
+		Description: "Distribution of slack API latency by method",
+		Measure:     mSlackLatency,
+		TagKeys:     []tag.Key{keyMethod, keyResult},
+		Aggregation: latencyDistribution,
+	},
+	{
+		Name:        "dan_demand/slack_throttled",
+		Description: "Count of slack API calls delayed by a rate limit, by method",
+		Measure:     mSlackThrottleWait,
+		TagKeys:     []tag.Key{keyMethod},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "dan_demand/slack_throttle_wait",
+		Description: "Distribution of time spent waiting out slack rate limits, by method",
+		Measure:     mSlackThrottleWait,
+		TagKeys:     []tag.Key{keyMethod},
+		Aggregation: latencyDistribution,
+	},
+	{
+		Name:        "dan_demand/user_cache_size",
+		Description: "Number of users in the user cache",
+		Measure:     mUserCacheSize,
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "dan_demand/user_refresh_duration",
+		Description: "Distribution of time taken to refresh the user cache",
+		Measure:     mUserRefreshDuration,
+		Aggregation: latencyDistribution,
+	},
+	{
+		Name:        "dan_demand/queue_depth",
+		Description: "Number of demands waiting to be sent",
+		Measure:     mQueueDepth,
+		Aggregation: view.LastValue(),
+	},
+}
+
+// sinceMillis returns the time elapsed since start in milliseconds
+func sinceMillis(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// recipientAlias identifies a recipient in metrics without exposing their number. Like in the logs
+// only the last 4 digits are kept, along with the channel, e.g. "whatsapp:***0100".
+func recipientAlias(recipient string) string {
+	addr := parseTwilioAddress(recipient)
+	number := addr.Number
+	if len(number) > 4 {
+		number = number[len(number)-4:]
+	}
+	return addr.Channel + ":***" + number
+}
+
+// withDemandTags tags the context so every measurement made while handling a demand can be broken
+// down by channel type and recipient
+func withDemandTags(ctx context.Context, channelType, recipient string) context.Context {
+	tagged, err := tag.New(ctx,
+		tag.Upsert(keyChannelType, channelType),
+		tag.Upsert(keyRecipient, recipientAlias(recipient)),
+	)
+	if err != nil {
+		return ctx
+	}
+	return tagged
+}
+
+// recordDemand counts a demand changing status, reason is only set for failures
+func recordDemand(ctx context.Context, status, reason string) {
+	stats.RecordWithTags(ctx,
+		[]tag.Mutator{tag.Upsert(keyStatus, status), tag.Upsert(keyReason, reason)},
+		mDemands.M(1),
+	)
+}
+
+// recordSlackCall records the latency and outcome of a slack API call and logs it at debug level
+func recordSlackCall(ctx context.Context, method string, start time.Time, err error) {
+	result := "ok"
+	if _, limited := rateLimitDelay(err); limited {
+		result = "ratelimited"
+	} else if err != nil {
+		result = "error"
+	}
+	latency := sinceMillis(start)
+	stats.RecordWithTags(ctx,
+		[]tag.Mutator{tag.Upsert(keyMethod, method), tag.Upsert(keyResult, result)},
+		mSlackLatency.M(latency),
+	)
+	entry := loggerFrom(ctx).WithFields(logrus.Fields{"method": method, "latency_ms": latency})
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Debug("slack call")
+}
+
+// recordTwilioCall records the latency and status code of a twilio API call and logs it at debug
+// level. A zero status code means no response was received.
+func recordTwilioCall(ctx context.Context, endpoint string, start time.Time, statusCode int) {
+	code := "none"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	latency := sinceMillis(start)
+	stats.RecordWithTags(ctx,
+		[]tag.Mutator{tag.Upsert(keyEndpoint, endpoint), tag.Upsert(keyStatusCode, code)},
+		mTwilioLatency.M(latency),
+	)
+	loggerFrom(ctx).WithFields(logrus.Fields{
+		"endpoint":    endpoint,
+		"status_code": code,
+		"latency_ms":  latency,
+	}).Debug("twilio call")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 5 * time.Second
+
+// staticSettings can only be applied at startup, changes to them are logged and ignored on reload
+var staticSettings = []string{
+	"server.address",
+	"server.zpages_address",
+	"server.public_url",
+	"slack.bot_token",
+	"slack.bot_token_file",
+	"slack.app_token",
+	"slack.app_token_file",
+	"slack.api_url",
+	"slack.user_cache_file",
+	"twilio.account_sid",
+	"twilio.token",
+	"twilio.token_file",
+	"twilio.base_url",
+	"twilio.from_numbers",
+	"twilio.messaging_service_sid",
+	"demand.state_file",
+	"email.smtp_address",
+	"email.username",
+	"email.password",
+	"email.password_file",
+	"email.from",
+	"capture.file",
+	"capture.max_size_mb",
+	"capture.backups",
+	"tracing.exporter",
+	"tracing.sample_fraction",
+	"tracing.endpoint",
+	"tracing.file",
+}
+
+// keepStaticSettings copies every static setting from current into next and returns the names of
+// the ones that differed
+func keepStaticSettings(current, next *DanDemandConfig) []string {
+	var changed []string
+	currentFields := current.fields()
+	nextFields := next.fields()
+	for _, key := range staticSettings {
+		old, updated := currentFields[key].value, nextFields[key].value
+		if !reflect.DeepEqual(old.Interface(), updated.Interface()) {
+			changed = append(changed, key)
+			updated.Set(old)
+		}
+	}
+	return changed
+}
+
+// Reload swaps in a new, already validated, configuration. Settings that can only be applied at
+// startup keep their current values.
+func (e *Engine) Reload(config *DanDemandConfig) error {
+	for _, key := range keepStaticSettings(e.currentConfig(), config) {
+		logger.WithField("setting", key).Warning("setting changed but requires a restart to take effect")
+	}
+
+	settings, err := newEngineSettings(config)
+	if err != nil {
+		return err
+	}
+	limit, err := time.ParseDuration(config.Twilio.Limit)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse rate_limit duration '%s': ", config.Twilio.Limit)
+	}
+	refreshInterval, err := time.ParseDuration(config.Slack.RefreshInterval)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse refresh_interval")
+	}
+
+	if err := setupLogging(config); err != nil {
+		return err
+	}
+	e.twilioClient.SetLimit(limit)
+	e.twilioClient.SetNumbers(config.Twilio)
+	e.slackWrapper.SetRefreshInterval(refreshInterval)
+	e.slackWrapper.SetUserFormat(config.Slack.UserFormat)
+	e.dispatcher.SetConfig(*config.Slack)
+	e.settings.Store(settings)
+	return nil
+}
+
+// ConfigReloader reloads the configuration into an Engine whenever the config file changes or the
+// process receives SIGHUP.
+type ConfigReloader struct {
+	path      string
+	overrides []string
+	engine    *Engine
+
+	lastModified time.Time
+}
+
+func NewConfigReloader(path string, overrides []string, engine *Engine) *ConfigReloader {
+	cr := &ConfigReloader{
+		path:      path,
+		overrides: overrides,
+		engine:    engine,
+	}
+	if info, err := os.Stat(path); err == nil {
+		cr.lastModified = info.ModTime()
+	}
+	return cr
+}
+
+// modified reports whether the config file changed since we last looked at it
+func (cr *ConfigReloader) modified() bool {
+	if cr.path == "" {
+		return false
+	}
+	info, err := os.Stat(cr.path)
+	if err != nil {
+		logger.WithError(err).WithField("path", cr.path).Error("failed to stat config file")
+		return false
+	}
+	if info.ModTime().Equal(cr.lastModified) {
+		return false
+	}
+	cr.lastModified = info.ModTime()
+	return true
+}
+
+// reload loads and validates the configuration and hands it to the engine, recording the outcome
+func (cr *ConfigReloader) reload(reason string) {
+	err := func() error {
+		config, err := LoadConfig(cr.path, cr.overrides)
+		if err != nil {
+			return errors.Wrap(err, "failed to load config: ")
+		}
+		if err := config.Validate(); err != nil {
+			return err
+		}
+		return cr.engine.Reload(config)
+	}()
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+		logger.WithError(err).WithField("reason", reason).Error("config reload failed, keeping the current config")
+	} else {
+		logger.WithField("reason", reason).Info("config reloaded")
+	}
+	stats.RecordWithTags(
+		context.Background(),
+		[]tag.Mutator{tag.Upsert(keyResult, result)},
+		mConfigReloads.M(1),
+	)
+}
+
+// Run watches for config changes forever
+func (cr *ConfigReloader) Run() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		loopHeartbeats.Beat("config-reloader", configPollInterval)
+		select {
+		case <-hangups:
+			cr.modified()
+			cr.reload("SIGHUP")
+		case <-ticker.C:
+			if cr.modified() {
+				cr.reload("file changed")
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReplayCapturedEvents(t *testing.T) {
+	events, err := readCaptureFiles([]string{"testdata/replay.jsonl"})
+	if err != nil {
+		t.Fatalf("failed to read captured events: %v", err)
+	}
+
+	config := newDanDemandConfig()
+	if err := config.apply(defaultsLayer()); err != nil {
+		t.Fatalf("failed to apply defaults: %v", err)
+	}
+	config.Slack.RefreshInterval = "1h"
+	config.Slack.ReactionEmoji = "dan"
+	results, err := ReplayEvents(config, events)
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if len(results) != len(events) {
+		t.Fatalf("expected %d results, got %d", len(events), len(results))
+	}
+
+	// expected is the type and SMS of each event in testdata/replay.jsonl, the SMS is empty when
+	// the event should be ignored
+	expected := []struct {
+		eventType string
+		sms       string
+	}{
+		{"message", "#D1 ualice: <@dan-demand> coffee please"},
+		{"message/file_share", "#D2 ubob: <@dan-demand> look at this"},
+		{"message", ""},
+		{"message/bot_message", ""},
+		{"message", ""},
+		{"reaction_added", "#D3 ubob (via ualice): the build is on fire"},
+	}
+	for index, want := range expected {
+		result := results[index]
+		if result.Type != want.eventType {
+			t.Errorf("event %d: expected type %s, got %s", index+1, want.eventType, result.Type)
+		}
+		if result.Status != http.StatusOK {
+			t.Errorf("event %d: expected 200, got %d", index+1, result.Status)
+		}
+		if want.sms == "" {
+			if len(result.Messages) != 0 {
+				t.Errorf("event %d: expected no SMS, got %v", index+1, result.Messages)
+			}
+			continue
+		}
+		if len(result.Messages) != 1 || result.Messages[0].Body != want.sms {
+			t.Errorf("event %d: expected SMS %q, got %v", index+1, want.sms, result.Messages)
+		}
+	}
+
+	if media := results[1].Messages; len(media) == 1 {
+		if len(media[0].MediaURLs) != 1 || !strings.Contains(media[0].MediaURLs[0], "pub_secret=") {
+			t.Errorf("expected the shared file to be attached, got %v", media[0].MediaURLs)
+		}
+	}
+}
@@ -2,15 +2,30 @@ package main
 
 import (
 	"context"
-	"runtime"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/nlopes/slack"
 	"github.com/nlopes/slack/slackevents"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/trace"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	// userPageSize is how many users are requested per users.list call, slack recommends 200
+	userPageSize = 200
+	// userPageTimeout bounds each users.list page, so a refresh of a large workspace can take as
+	// many pages as it needs
+	userPageTimeout = 30 * time.Second
+	// userSnapshotInterval is how often changes made by user events are written to the user cache
+	userSnapshotInterval = time.Minute
 )
 
 // SlackWrapper is used to combine the bot api client and the app api client and expose the methods
@@ -19,16 +34,49 @@ type SlackWrapper struct {
 	config SlackConfig
 
 	refreshInterval time.Duration
+	refreshUpdate   chan time.Duration
 
 	appClient *slack.Client
 	botClient *slack.Client
 
 	BotUID string
 
-	// These are used to build a strings.Replacer that will autoreplace all UIDs with usernames
-	replacerLock sync.RWMutex
-	userMap      map[string]string
-	userReplacer *strings.Replacer
+	// directory resolves user IDs to names, it is refreshed in the background and kept up to date
+	// by user_change and team_join events
+	directory *UserDirectory
+	// throttle tracks the methods slack is rate limiting
+	throttle *slackThrottle
+	// files downloads private files with the bot token
+	files *http.Client
+}
+
+// slackAPITransport sends requests for the slack library's API URL to the configured one. The
+// library only supports a single, package wide, API URL, which wrappers talking to different APIs
+// cannot share.
+type slackAPITransport struct {
+	apiURL string
+	next   http.RoundTripper
+}
+
+func (st *slackAPITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if path := strings.TrimPrefix(req.URL.String(), slack.APIURL); path != req.URL.String() {
+		target, err := url.Parse(st.apiURL + path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to rewrite slack API URL: ")
+		}
+		req = req.WithContext(req.Context())
+		req.URL = target
+		req.Host = target.Host
+	}
+	return st.next.RoundTrip(req)
+}
+
+// newSlackHTTPClient returns a traced client for the slack library that talks to apiURL
+func newSlackHTTPClient(apiURL string) *http.Client {
+	return &http.Client{Transport: &slackAPITransport{
+		apiURL: strings.TrimRight(apiURL, "/") + "/",
+		next:   newTracedHTTPClient().Transport,
+	}}
 }
 
 func NewSlackWrapper(config SlackConfig) (*SlackWrapper, error) {
@@ -40,27 +88,53 @@ func NewSlackWrapper(config SlackConfig) (*SlackWrapper, error) {
 	wrapper := &SlackWrapper{
 		config:          config,
 		refreshInterval: refreshInterval,
-		appClient:       slack.New(config.AppToken),
-		botClient:       slack.New(config.BotToken),
-		userMap:         make(map[string]string),
+		refreshUpdate:   make(chan time.Duration, 1),
+		appClient:       slack.New(config.AppToken, slack.OptionHTTPClient(newSlackHTTPClient(config.APIURL))),
+		botClient:       slack.New(config.BotToken, slack.OptionHTTPClient(newSlackHTTPClient(config.APIURL))),
+		directory:       NewUserDirectory(),
+		throttle:        newSlackThrottle(),
+		files:           newTracedHTTPClient(),
+	}
+	wrapper.directory.SetFormat(config.UserFormat)
+
+	// A snapshot lets names resolve before the first refresh, which can take a long time on
+	// large workspaces
+	if config.UserCacheFile != "" {
+		if err := wrapper.directory.Load(config.UserCacheFile); err != nil {
+			logger.WithError(err).Warning("ignoring unreadable user cache")
+		} else if users := wrapper.directory.Len(); users > 0 {
+			logger.WithFields(logrus.Fields{
+				"users":      users,
+				"updated_at": wrapper.directory.LastRefresh(),
+			}).Info("loaded user cache")
+		}
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), slackBackgroundTimeout)
+	defer cancel()
+
 	// Use the AuthTest method to grab out bot username and userid so we can do
 	// translations of our own name in mentions correctly
-	authResp, err := wrapper.botClient.AuthTest()
+	var authResp *slack.AuthTestResponse
+	err = wrapper.call(ctx, "auth.test", func(ctx context.Context) error {
+		var err error
+		authResp, err = wrapper.botClient.AuthTestContext(ctx)
+		return err
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to authenticate bot client: ")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
 	_, err = wrapper.LookupUserName(ctx, authResp.UserID)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to lookup bot username: ")
 	}
 	wrapper.BotUID = authResp.UserID
 
-	_, err = wrapper.appClient.AuthTest()
+	err = wrapper.call(ctx, "auth.test", func(ctx context.Context) error {
+		_, err := wrapper.appClient.AuthTestContext(ctx)
+		return err
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to authenticate app client: ")
 	}
@@ -99,97 +173,223 @@ func largestThumbnailLink(f slackevents.File) (string, error) {
 	return "", errors.New("no thumbnails found")
 }
 
-// ReplaceUIDs attempts to replace all the UIDs we know about with their usernames.
+// ReplaceUIDs replaces every mention of a user we know about with their username.
 func (sw *SlackWrapper) ReplaceUIDs(text string) string {
-	sw.replacerLock.RLock()
-	defer sw.replacerLock.RUnlock()
-	return sw.userReplacer.Replace(text)
+	return sw.directory.ReplaceMentions(text)
 }
 
-// userRefresher is a background thread that periodically scrapes the list of all users to load our
-// replacer.
-func (sw *SlackWrapper) userRefresher() {
-	ticker := time.NewTicker(sw.refreshInterval)
-	for range ticker.C {
-		requestStart := time.Now()
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-		users, err := sw.appClient.GetUsersContext(ctx)
-		requestLatency := time.Since(requestStart)
-		cancel()
+// SetUserFormat changes how users are named in demands
+func (sw *SlackWrapper) SetUserFormat(format string) {
+	sw.directory.SetFormat(format)
+}
 
+// SetRefreshInterval changes how often the user list is refreshed
+func (sw *SlackWrapper) SetRefreshInterval(interval time.Duration) {
+	// Drop any update the refresher has not picked up yet, only the latest one matters
+	select {
+	case <-sw.refreshUpdate:
+	default:
+	}
+	sw.refreshUpdate <- interval
+}
+
+// fetchUsers pages through users.list to get every member of the workspace
+func (sw *SlackWrapper) fetchUsers(ctx context.Context) ([]slack.User, error) {
+	var users []slack.User
+	pages := sw.appClient.GetUsersPaginated(slack.GetUsersOptionLimit(userPageSize))
+	for {
+		// A refresh of a large workspace can take longer than the refresh interval, every page is
+		// progress though
+		loopHeartbeats.Beat("user-refresher", userPageTimeout)
+		var done bool
+		pageCtx, cancel := context.WithTimeout(ctx, userPageTimeout)
+		err := sw.call(pageCtx, "users.list", func(ctx context.Context) error {
+			next, err := pages.Next(ctx)
+			if pages.Done(err) {
+				done = true
+				return nil
+			}
+			if err == nil {
+				pages = next
+			}
+			return err
+		})
+		cancel()
 		if err != nil {
-			glog.Error(errors.Wrap(err, "failed to refresh slack users: "))
-			continue
+			return nil, errors.Wrapf(err, "failed to list users after %d: ", len(users))
+		}
+		if done {
+			return users, nil
 		}
+		users = append(users, pages.Users...)
+	}
+}
+
+// refreshUsers reloads the whole user directory so renames and deactivations we missed events for
+// are picked up
+func (sw *SlackWrapper) refreshUsers() error {
+	start := time.Now()
+	ctx := context.Background()
+	users, err := sw.fetchUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return errors.New("users.list returned no users")
+	}
+	changes := sw.directory.Replace(users, start)
+	sw.SaveUsers()
+	stats.Record(ctx,
+		mUserRefreshDuration.M(sinceMillis(start)),
+		mUserCacheSize.M(int64(len(users))),
+	)
+	logger.WithFields(logrus.Fields{
+		"users":       len(users),
+		"added":       changes.Added,
+		"renamed":     changes.Renamed,
+		"deactivated": changes.Deactivated,
+		"duration":    time.Since(start).String(),
+	}).Info("user refresh complete")
+	return nil
+}
 
-		// Bail early if we have the same number of users, not the most perfect heurstic, but good
-		// enough since we also lazily load user names.
-		sw.replacerLock.RLock()
-		if len(sw.userMap) == len(users) || len(users) == 0 {
-			sw.replacerLock.RUnlock()
+// userRefresher is a background thread that periodically reloads the user directory
+func (sw *SlackWrapper) userRefresher() {
+	interval := sw.refreshInterval
+	// A loaded snapshot is reconciled once it is as old as the interval, not a whole interval
+	// after startup, so restarts cannot keep postponing the refresh
+	refresh := time.NewTimer(interval - time.Since(sw.directory.LastRefresh()))
+	snapshots := time.NewTicker(userSnapshotInterval)
+	for {
+		loopHeartbeats.Beat("user-refresher", interval)
+		select {
+		case <-refresh.C:
+		case <-snapshots.C:
+			sw.SaveUsers()
+			continue
+		case interval = <-sw.refreshUpdate:
+			if !refresh.Stop() {
+				select {
+				case <-refresh.C:
+				default:
+				}
+			}
+			refresh.Reset(interval)
+			logger.WithField("interval", interval.String()).Info("user refresh interval changed")
 			continue
 		}
-		sw.replacerLock.RUnlock()
-
-		// Generate our new map and replacer
-		refreshStart := time.Now()
-		newMap := make(map[string]string, len(users))
-		replacerSlice := make([]string, 0, len(users))
-		for _, user := range users {
-			newMap[user.ID] = user.Name
-			replacerSlice = append(replacerSlice, user.ID, user.Name)
+		if err := sw.refreshUsers(); err != nil {
+			logger.WithError(err).Error("failed to refresh slack users")
 		}
-		newReplacer := strings.NewReplacer(replacerSlice...)
-		refreshLatency := time.Since(refreshStart)
+		refresh.Reset(interval)
+	}
+}
 
-		// Acquire lock and replace the map and replacer
-		sw.replacerLock.Lock()
-		sw.userReplacer = newReplacer
-		sw.userMap = newMap
-		sw.replacerLock.Unlock()
-		glog.Infof("refresh of %d users complete: downloaded in %v, refreshed in %v", len(newMap), requestLatency, refreshLatency)
-		// Explicitly trigger a GC after replacing the map and replacer values so we reclaim that
-		// memory quickly and don't OOM
-		runtime.GC()
+// SaveUsers writes the user directory to the user cache if it changed
+func (sw *SlackWrapper) SaveUsers() {
+	if sw.config.UserCacheFile == "" {
+		return
+	}
+	if err := sw.directory.Save(sw.config.UserCacheFile); err != nil {
+		logger.WithError(err).Error("failed to save user cache")
 	}
 }
 
-// LookupUserName is used to populate our mapping of UID to Username. It also rebuilds the
-// internal strings.Replacer to include the new user name.
-// TODO(rossdylan): Look into doing the Replacer refresh in a goroutine to avoid blocking for a
-// long time on huge maps
+// UpdateUser applies a user_change or team_join event to the user directory
+func (sw *SlackWrapper) UpdateUser(ctx context.Context, user slack.User) {
+	old, existed := sw.directory.Get(user.ID)
+	changes := sw.directory.Put(user)
+	log := loggerFrom(ctx).WithField("uid", user.ID)
+	switch {
+	case changes.Added > 0:
+		log.WithField("name", user.Name).Info("user joined")
+	case changes.Renamed > 0:
+		log.WithFields(logrus.Fields{"old_name": old.Name, "name": user.Name}).Info("user renamed")
+	}
+	if changes.Deactivated > 0 {
+		log.Info("user deactivated")
+	}
+	if !existed {
+		stats.Record(ctx, mUserCacheSize.M(int64(sw.directory.Len())))
+	}
+}
+
+// LastRefresh returns when the full user list was last loaded, it is zero until the first refresh
+func (sw *SlackWrapper) LastRefresh() time.Time {
+	return sw.directory.LastRefresh()
+}
+
+// Users returns a copy of the cached UID to user name mapping
+func (sw *SlackWrapper) Users() map[string]string {
+	return sw.directory.Names()
+}
+
+// AuthTest checks that both the bot and app tokens are still valid
+func (sw *SlackWrapper) AuthTest(ctx context.Context) error {
+	err := sw.call(ctx, "auth.test", func(ctx context.Context) error {
+		_, err := sw.botClient.AuthTestContext(ctx)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to authenticate bot client: ")
+	}
+	err = sw.call(ctx, "auth.test", func(ctx context.Context) error {
+		_, err := sw.appClient.AuthTestContext(ctx)
+		return err
+	})
+	return errors.Wrap(err, "failed to authenticate app client: ")
+}
+
+// LookupUserName returns how a user should be named, asking slack about users we have not seen.
 func (sw *SlackWrapper) LookupUserName(ctx context.Context, uid string) (string, error) {
-	sw.replacerLock.RLock()
-	val, ok := sw.userMap[uid]
-	sw.replacerLock.RUnlock()
+	ctx, span := trace.StartSpan(ctx, "slack.LookupUserName")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("uid", uid))
+
+	name, ok := sw.directory.Name(uid)
+	span.AddAttributes(trace.BoolAttribute("cache_hit", ok))
 	if ok {
-		return val, nil
+		return name, nil
 	}
 
-	user, err := sw.appClient.GetUserInfoContext(ctx, uid)
+	var user *slack.User
+	err := sw.call(ctx, "users.info", func(ctx context.Context) error {
+		var err error
+		user, err = sw.appClient.GetUserInfoContext(ctx, uid)
+		return err
+	})
 	if err != nil {
+		setSpanError(span, err)
 		return "", errors.Wrap(err, "failed to lookup user info: ")
 	}
 
-	sw.replacerLock.Lock()
-	defer sw.replacerLock.Unlock()
-	sw.userMap[uid] = user.Name
-	var pairs []string
-	for k, v := range sw.userMap {
-		pairs = append(pairs, k, v)
-	}
-	glog.Infof("loaded uid replacer with %d replacements", len(sw.userMap))
-	sw.userReplacer = strings.NewReplacer(pairs...)
-	return user.Name, nil
+	sw.directory.Put(*user)
+	stats.Record(ctx, mUserCacheSize.M(int64(sw.directory.Len())))
+	name, _ = sw.directory.Name(uid)
+	return name, nil
 }
 
 // ShareFilePublic is used to publically share a file and generate a direct link to it.
 // NOTE(rossdylan): This is a bit dangerous since it requires the App level client and has access to
 // all files in the workspace.
 func (sw *SlackWrapper) ShareFilePublic(ctx context.Context, file *slackevents.File) (string, error) {
-	slackFile, _, _, err := sw.appClient.ShareFilePublicURLContext(ctx, file.ID)
+	ctx, span := trace.StartSpan(ctx, "slack.ShareFilePublic")
+	defer span.End()
+	span.AddAttributes(
+		trace.StringAttribute("file.id", file.ID),
+		trace.Int64Attribute("file.size", int64(file.Size)),
+		trace.BoolAttribute("file.thumbnail", file.Size > twilioFileSizeLimit),
+	)
+
+	var slackFile *slack.File
+	err := sw.call(ctx, "files.sharedPublicURL", func(ctx context.Context) error {
+		var err error
+		slackFile, _, _, err = sw.appClient.ShareFilePublicURLContext(ctx, file.ID)
+		return err
+	})
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to share file '%s': ", slackFile.Name)
+		setSpanError(span, err)
+		return "", errors.Wrapf(err, "failed to share file '%s': ", file.Name)
 	}
 
 	// NOTE(rossdylan) HAX Alert, files are defined with 3 '-' seperate identifiers, in the public
@@ -205,27 +405,221 @@ func (sw *SlackWrapper) ShareFilePublic(ctx context.Context, file *slackevents.F
 		}
 		return largestThumbnail + secretBits, nil
 	}
+	stats.Record(ctx, mMediaBytes.M(int64(file.Size)))
 	return slackFile.URLPrivateDownload + secretBits, nil
 }
 
+// GetMessage fetches a single message by its timestamp. Channel history only has top level
+// messages, so replies in threads are looked up with conversations.replies instead.
+func (sw *SlackWrapper) GetMessage(ctx context.Context, channel, timestamp string) (*slack.Message, error) {
+	message, err := sw.getHistoryMessage(ctx, channel, timestamp)
+	if err != nil || message != nil {
+		return message, err
+	}
+	// Reaction events do not say whether the message is in a thread, replies accept the timestamp
+	// of any message in a thread though
+	var replies []slack.Message
+	err = sw.call(ctx, "conversations.replies", func(ctx context.Context) error {
+		var err error
+		replies, _, _, err = sw.appClient.GetConversationRepliesContext(ctx, &slack.GetConversationRepliesParameters{
+			ChannelID: channel,
+			Timestamp: timestamp,
+			Latest:    timestamp,
+			Inclusive: true,
+			Limit:     1,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch replies for '%s' in '%s': ", timestamp, channel)
+	}
+	for index := range replies {
+		if replies[index].Timestamp == timestamp {
+			return &replies[index], nil
+		}
+	}
+	return nil, errors.Errorf("message '%s' not found in '%s'", timestamp, channel)
+}
+
+// getHistoryMessage fetches a top level message from a channel's history, it returns nil if there
+// is no such message
+func (sw *SlackWrapper) getHistoryMessage(ctx context.Context, channel, timestamp string) (*slack.Message, error) {
+	var history *slack.GetConversationHistoryResponse
+	err := sw.call(ctx, "conversations.history", func(ctx context.Context) error {
+		var err error
+		history, err = sw.appClient.GetConversationHistoryContext(ctx, &slack.GetConversationHistoryParameters{
+			ChannelID: channel,
+			Latest:    timestamp,
+			Inclusive: true,
+			Limit:     1,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch history for '%s': ", channel)
+	}
+	for index := range history.Messages {
+		if history.Messages[index].Timestamp == timestamp {
+			return &history.Messages[index], nil
+		}
+	}
+	return nil, nil
+}
+
+// GetThreadReplies fetches every message in a thread, starting with the parent message.
+func (sw *SlackWrapper) GetThreadReplies(ctx context.Context, channel, threadTimestamp string) ([]slack.Message, error) {
+	params := &slack.GetConversationRepliesParameters{
+		ChannelID: channel,
+		Timestamp: threadTimestamp,
+	}
+	var messages []slack.Message
+	for {
+		var page []slack.Message
+		var hasMore bool
+		var cursor string
+		err := sw.call(ctx, "conversations.replies", func(ctx context.Context) error {
+			var err error
+			page, hasMore, cursor, err = sw.appClient.GetConversationRepliesContext(ctx, params)
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch replies for '%s' in '%s': ", threadTimestamp, channel)
+		}
+		messages = append(messages, page...)
+		if !hasMore || cursor == "" {
+			return messages, nil
+		}
+		params.Cursor = cursor
+	}
+}
+
+// isSlackURL reports whether rawURL is served by slack over https, or by the configured API
+func (sw *SlackWrapper) isSlackURL(rawURL string) bool {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	if api, err := url.Parse(sw.config.APIURL); err == nil && target.Scheme == api.Scheme && target.Host == api.Host {
+		return true
+	}
+	host := target.Hostname()
+	return target.Scheme == "https" && (host == "slack.com" || strings.HasSuffix(host, ".slack.com"))
+}
+
+// DownloadFile fetches the contents of a file shared with the bot, failing if it is larger than
+// limit bytes
+func (sw *SlackWrapper) DownloadFile(ctx context.Context, file *slackevents.File, limit int64) ([]byte, error) {
+	ctx, span := trace.StartSpan(ctx, "slack.DownloadFile")
+	defer span.End()
+	// The URL comes from the event payload, the bot token must only ever be sent to slack
+	if !sw.isSlackURL(file.URLPrivateDownload) {
+		return nil, errors.Errorf("refusing to download file '%s' from outside slack", file.Name)
+	}
+	req, err := http.NewRequest("GET", file.URLPrivateDownload, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to construct request: ")
+	}
+	req.Header.Set("Authorization", "Bearer "+sw.config.BotToken)
+	resp, err := ctxhttp.Do(ctx, sw.files, req)
+	if err != nil {
+		setSpanError(span, err)
+		return nil, errors.Wrapf(err, "failed to download file '%s': ", file.Name)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to download file '%s': %s", file.Name, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to download file '%s': ", file.Name)
+	}
+	if int64(len(data)) > limit {
+		return nil, errors.Errorf("file '%s' is larger than %d bytes", file.Name, limit)
+	}
+	span.AddAttributes(trace.Int64Attribute("file.size", int64(len(data))))
+	return data, nil
+}
+
+// Permalink returns a link to a message that opens it in slack
+func (sw *SlackWrapper) Permalink(ctx context.Context, channel, timestamp string) (string, error) {
+	var link string
+	err := sw.call(ctx, "chat.getPermalink", func(ctx context.Context) error {
+		var err error
+		link, err = sw.botClient.GetPermalinkContext(ctx, &slack.PermalinkParameters{Channel: channel, Ts: timestamp})
+		return err
+	})
+	return link, errors.Wrapf(err, "failed to get permalink of '%s' in '%s': ", timestamp, channel)
+}
+
+// eventFileFromSlack converts a file returned by the web API into the events API representation
+// so it can be shared with ShareFilePublic.
+func eventFileFromSlack(f slack.File) slackevents.File {
+	return slackevents.File{
+		ID:                 f.ID,
+		Name:               f.Name,
+		Title:              f.Title,
+		Mimetype:           f.Mimetype,
+		Filetype:           f.Filetype,
+		User:               f.User,
+		Size:               f.Size,
+		IsPublic:           f.IsPublic,
+		URLPrivate:         f.URLPrivate,
+		URLPrivateDownload: f.URLPrivateDownload,
+		Thumb64:            f.Thumb64,
+		Thumb80:            f.Thumb80,
+		Thumb160:           f.Thumb160,
+		Thumb360:           f.Thumb360,
+		Thumb480:           f.Thumb480,
+		Thumb720:           f.Thumb720,
+		Thumb960:           f.Thumb960,
+		Thumb1024:          f.Thumb1024,
+		Permalink:          f.Permalink,
+		PermalinkPublic:    f.PermalinkPublic,
+	}
+}
+
+// PostThreadReply posts a message as the bot in the thread of the given message
+func (sw *SlackWrapper) PostThreadReply(ctx context.Context, channel, timestamp, text string) error {
+	err := sw.call(ctx, "chat.postMessage", func(ctx context.Context) error {
+		_, _, err := sw.botClient.PostMessageContext(
+			ctx,
+			channel,
+			slack.MsgOptionText(text, false),
+			slack.MsgOptionTS(timestamp),
+		)
+		return err
+	})
+	return errors.Wrapf(err, "failed to reply to '%s' in '%s': ", timestamp, channel)
+}
+
+// PostThreadReplyBackground posts a thread reply without blocking the caller
+func (sw *SlackWrapper) PostThreadReplyBackground(ctx context.Context, channel, timestamp, text string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(detachContext(ctx), slackBackgroundTimeout)
+		defer cancel()
+		err := sw.PostThreadReply(ctx, channel, timestamp, text)
+		if err != nil {
+			loggerFrom(ctx).WithError(err).Error("failed to post thread reply")
+		}
+	}()
+}
+
 // AddReaction adds an emoji reaction to the given reference
 func (sw *SlackWrapper) AddReaction(ctx context.Context, emoji, channel, timestamp string) error {
 	ref := slack.ItemRef{Channel: channel, Timestamp: timestamp}
-	err := sw.botClient.AddReactionContext(
-		ctx,
-		emoji,
-		ref,
-	)
+	err := sw.call(ctx, "reactions.add", func(ctx context.Context) error {
+		return sw.botClient.AddReactionContext(ctx, emoji, ref)
+	})
 	return errors.Wrapf(err, "failed to add reaction to '%#v': ", ref)
 }
 
-func (sw *SlackWrapper) AddReactionBackground(emoji, channel, timestamp string) {
+func (sw *SlackWrapper) AddReactionBackground(ctx context.Context, emoji, channel, timestamp string) {
 	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		ctx, cancel := context.WithTimeout(detachContext(ctx), slackBackgroundTimeout)
 		defer cancel()
 		err := sw.AddReaction(ctx, emoji, channel, timestamp)
 		if err != nil {
-			glog.Error(err)
+			loggerFrom(ctx).WithError(err).Error("failed to add reaction")
 		}
 	}()
 }
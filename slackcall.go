@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+const (
+	// slackMaxAttempts bounds how many times a rate limited call is tried
+	slackMaxAttempts = 5
+	// slackBackgroundTimeout is how long background reactions and replies may spend waiting out
+	// rate limits
+	slackBackgroundTimeout = 30 * time.Second
+)
+
+// slackTierBackoff is how long to wait before retrying a rate limited call when slack does not say,
+// roughly the interval each tier allows between calls. See https://api.slack.com/docs/rate-limits
+var slackTierBackoff = map[int]time.Duration{
+	1: time.Minute,
+	2: 3 * time.Second,
+	3: 1200 * time.Millisecond,
+	4: 600 * time.Millisecond,
+}
+
+// slackMethodTiers is the rate limit tier of every web API method we call. chat.postMessage has
+// its own limit of about one message per second per channel, which is treated like tier 4.
+var slackMethodTiers = map[string]int{
+	"auth.test":             4,
+	"users.list":            2,
+	"users.info":            4,
+	"reactions.add":         3,
+	"files.sharedPublicURL": 3,
+	"conversations.history": 3,
+	"conversations.replies": 3,
+	"chat.postMessage":      4,
+	"chat.getPermalink":     4,
+}
+
+// rateLimitDelay reports whether err is slack rate limiting us and how long it asked us to wait,
+// zero if it did not say
+func rateLimitDelay(err error) (time.Duration, bool) {
+	switch cause := errors.Cause(err).(type) {
+	case *slack.RateLimitedError:
+		return cause.RetryAfter, true
+	case nil:
+		return 0, false
+	default:
+		// Some methods report rate limits in the response body instead of with a 429
+		return 0, cause.Error() == "ratelimited"
+	}
+}
+
+// slackThrottle remembers which methods slack is currently rate limiting so every caller of a
+// method backs off, not only the one that was refused
+type slackThrottle struct {
+	lock         sync.Mutex
+	blockedUntil map[string]time.Time
+}
+
+func newSlackThrottle() *slackThrottle {
+	return &slackThrottle{blockedUntil: make(map[string]time.Time)}
+}
+
+// block stops calls to method until the given time
+func (st *slackThrottle) block(method string, until time.Time) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if until.After(st.blockedUntil[method]) {
+		st.blockedUntil[method] = until
+	}
+}
+
+// delay returns how long calls to method must wait
+func (st *slackThrottle) delay(method string) time.Duration {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return time.Until(st.blockedUntil[method])
+}
+
+// backoff is how long to wait before attempt number attempt, counting from 1, of a rate limited
+// call. Slack's Retry-After wins when it is longer.
+func backoff(method string, attempt int, retryAfter time.Duration) time.Duration {
+	base, ok := slackTierBackoff[slackMethodTiers[method]]
+	if !ok {
+		base = slackTierBackoff[3]
+	}
+	wait := base << uint(attempt-1)
+	// Jitter keeps callers that were refused together from retrying together
+	wait += time.Duration(rand.Int63n(int64(base)/2 + 1))
+	if retryAfter > wait {
+		wait = retryAfter
+	}
+	return wait
+}
+
+// sleepContext waits for d unless ctx would expire first, in which case it returns false right
+// away since there is no point in waiting
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// recordThrottle records time spent waiting on a slack rate limit
+func recordThrottle(ctx context.Context, method string, wait time.Duration) {
+	stats.RecordWithTags(ctx,
+		[]tag.Mutator{tag.Upsert(keyMethod, method)},
+		mSlackThrottleWait.M(float64(wait)/float64(time.Millisecond)),
+	)
+}
+
+// call runs fn, a single call to the slack web API method, retrying it while slack rate limits us
+// as long as ctx allows. Calls to a method that is currently rate limited wait their turn first.
+func (sw *SlackWrapper) call(ctx context.Context, method string, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 1; attempt <= slackMaxAttempts; attempt++ {
+		if wait := sw.throttle.delay(method); wait > 0 {
+			if !sleepContext(ctx, wait) {
+				return errors.Errorf("gave up waiting %v for the %s rate limit", wait.Truncate(time.Millisecond), method)
+			}
+			recordThrottle(ctx, method, wait)
+		}
+
+		start := time.Now()
+		err = fn(ctx)
+		recordSlackCall(ctx, method, start, err)
+		retryAfter, limited := rateLimitDelay(err)
+		if !limited {
+			return err
+		}
+
+		wait := backoff(method, attempt, retryAfter)
+		sw.throttle.block(method, time.Now().Add(wait))
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			"method":  method,
+			"attempt": attempt,
+			"wait":    wait.String(),
+		}).Warning("slack rate limited us")
+	}
+	return errors.Wrapf(err, "still rate limited after %d attempts: ", slackMaxAttempts)
+}
@@ -0,0 +1,160 @@
+package slacktest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// Injector delivers synthetic Events API callbacks to a slack events endpoint the same way slack
+// does, including the verification token and the request signature.
+type Injector struct {
+	// URL is the full URL of the events endpoint, e.g. http://127.0.0.1:1234/slack-events
+	URL               string
+	TeamID            string
+	VerificationToken string
+	// SigningSecret signs every request, no signature is sent when it is empty
+	SigningSecret string
+
+	client *http.Client
+
+	lock     sync.Mutex
+	sequence int
+}
+
+// NewInjector returns an Injector for the events endpoint at url
+func NewInjector(url, verificationToken, signingSecret string) *Injector {
+	return &Injector{
+		URL:               url,
+		TeamID:            "T00000001",
+		VerificationToken: verificationToken,
+		SigningSecret:     signingSecret,
+		client:            &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NextEventID returns a new unique event ID
+func (in *Injector) NextEventID() string {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	in.sequence++
+	return fmt.Sprintf("Ev%08d", in.sequence)
+}
+
+// Sign computes the X-Slack-Signature header for a request body sent at timestamp
+func Sign(signingSecret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	fmt.Fprintf(mac, "v0:%d:", timestamp)
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Inject wraps an inner event in an event_callback envelope with a fresh event ID and delivers it
+func (in *Injector) Inject(event interface{}) (*http.Response, error) {
+	return in.InjectWithID(in.NextEventID(), event)
+}
+
+// InjectWithID delivers an inner event with the given event ID, reusing an ID simulates slack
+// retrying a delivery
+func (in *Injector) InjectWithID(eventID string, event interface{}) (*http.Response, error) {
+	inner, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"token":      in.VerificationToken,
+		"team_id":    in.TeamID,
+		"api_app_id": "A00000001",
+		"type":       "event_callback",
+		"event_id":   eventID,
+		"event_time": time.Now().Unix(),
+		"event":      json.RawMessage(inner),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return in.Post(body)
+}
+
+// Post delivers a raw request body, signing it if a signing secret is set
+func (in *Injector) Post(body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", in.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if in.SigningSecret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set("X-Slack-Request-Timestamp", strconv.FormatInt(timestamp, 10))
+		req.Header.Set("X-Slack-Signature", Sign(in.SigningSecret, timestamp, body))
+	}
+	return in.client.Do(req)
+}
+
+// MessageEvent builds a message event posted by user in a public channel
+func MessageEvent(channel, user, ts, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":         "message",
+		"channel":      channel,
+		"channel_type": "channel",
+		"user":         user,
+		"text":         text,
+		"ts":           ts,
+		"event_ts":     ts,
+	}
+}
+
+// MessageChangedEvent builds the message_changed event slack sends when user edits the message
+// posted at ts
+func MessageChangedEvent(channel, user, ts, text string) map[string]interface{} {
+	now := fmt.Sprintf("%d.000100", time.Now().Unix())
+	return map[string]interface{}{
+		"type":         "message",
+		"subtype":      "message_changed",
+		"hidden":       true,
+		"channel":      channel,
+		"channel_type": "channel",
+		"message": map[string]string{
+			"type": "message",
+			"user": user,
+			"text": text,
+			"ts":   ts,
+		},
+		"ts":       now,
+		"event_ts": now,
+	}
+}
+
+// ReactionAddedEvent builds a reaction_added event for a message
+func ReactionAddedEvent(channel, user, ts, reaction string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "reaction_added",
+		"user":     user,
+		"reaction": reaction,
+		"item": map[string]string{
+			"type":    "message",
+			"channel": channel,
+			"ts":      ts,
+		},
+		"event_ts": ts,
+	}
+}
+
+// UserChangeEvent builds a user_change event, slack sends it when a member's profile changes or
+// they are deactivated
+func UserChangeEvent(user slack.User) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "user_change",
+		"user":     user,
+		"event_ts": fmt.Sprintf("%d.000100", time.Now().Unix()),
+	}
+}
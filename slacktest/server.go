@@ -0,0 +1,429 @@
+// Package slacktest provides an in-process fake of the slack Web API methods dan-demand uses and a
+// helper that delivers signed events to a dan-demand server, so the whole slack to twilio path can
+// be tested without network access.
+package slacktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nlopes/slack"
+)
+
+// Reaction is an emoji reaction added through reactions.add
+type Reaction struct {
+	Name      string
+	Channel   string
+	Timestamp string
+}
+
+// Post is a message sent through chat.postMessage
+type Post struct {
+	Channel  string
+	Text     string
+	ThreadTS string
+}
+
+// Server is a fake slack Web API for a single workspace
+type Server struct {
+	TeamID string
+	// Permissive makes up unknown users, files and channels instead of reporting them as not
+	// found, which lets recorded events from a real workspace be replayed. Set it before use.
+	Permissive bool
+
+	server *httptest.Server
+
+	lock sync.Mutex
+	// identities maps every accepted token to the user it authenticates as
+	identities map[string]string
+	users      map[string]slack.User
+	files      map[string]slack.File
+	// fileData holds the contents served for files added with AddFileData
+	fileData map[string][]byte
+	// history holds the messages of every channel, oldest first
+	history   map[string][]slack.Message
+	reactions []Reaction
+	posts     []Post
+	sequence  int
+	// rateLimits holds the Retry-After seconds of the 429 responses queued for each method
+	rateLimits map[string][]int
+}
+
+// NewServer starts a fake slack Web API. Callers must Close it.
+func NewServer() *Server {
+	s := &Server{
+		TeamID:     "T00000001",
+		identities: make(map[string]string),
+		users:      make(map[string]slack.User),
+		files:      make(map[string]slack.File),
+		fileData:   make(map[string][]byte),
+		history:    make(map[string][]slack.Message),
+		rateLimits: make(map[string][]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth.test", s.authenticated(s.handleAuthTest))
+	mux.HandleFunc("/users.list", s.authenticated(s.handleUsersList))
+	mux.HandleFunc("/users.info", s.authenticated(s.handleUsersInfo))
+	mux.HandleFunc("/reactions.add", s.authenticated(s.handleReactionsAdd))
+	mux.HandleFunc("/files.sharedPublicURL", s.authenticated(s.handleFilesSharedPublicURL))
+	mux.HandleFunc("/chat.postMessage", s.authenticated(s.handleChatPostMessage))
+	mux.HandleFunc("/conversations.history", s.authenticated(s.handleConversationsHistory))
+	mux.HandleFunc("/conversations.replies", s.authenticated(s.handleConversationsReplies))
+	mux.HandleFunc("/chat.getPermalink", s.authenticated(s.handleChatGetPermalink))
+	mux.HandleFunc("/files-pri/", s.handleFileDownload)
+	s.server = httptest.NewServer(mux)
+	return s
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// APIURL is the value to configure as the slack API URL
+func (s *Server) APIURL() string {
+	return s.server.URL + "/"
+}
+
+// AddUser adds a member to the workspace
+func (s *Server) AddUser(id, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users[id] = slack.User{ID: id, Name: name, TeamID: s.TeamID, RealName: name}
+}
+
+// AddToken accepts token for API calls made on behalf of the user with the given ID
+func (s *Server) AddToken(token, userID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.identities[token] = userID
+}
+
+// AddFile makes a file available to files.sharedPublicURL
+func (s *Server) AddFile(file slack.File) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.files[file.ID] = file
+}
+
+// AddFileData adds a file whose private download URL serves data to any request carrying a known
+// token, and returns the file with that URL filled in
+func (s *Server) AddFileData(file slack.File, data []byte) slack.File {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file.URLPrivateDownload = fmt.Sprintf("%s/files-pri/%s-%s/download/%s", s.server.URL, s.TeamID, file.ID, file.Name)
+	s.files[file.ID] = file
+	s.fileData[file.ID] = data
+	return file
+}
+
+// AddMessage appends a message to a channel's history so it can be fetched by
+// conversations.history and conversations.replies
+func (s *Server) AddMessage(channel string, msg slack.Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.history[channel] = append(s.history[channel], msg)
+}
+
+// RateLimitNext makes the next call to method fail with a 429 asking the caller to retry after
+// the given number of seconds. Calls queue up, one per 429.
+func (s *Server) RateLimitNext(method string, retryAfter int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rateLimits[method] = append(s.rateLimits[method], retryAfter)
+}
+
+// rateLimited pops the next queued 429 for method, if any
+func (s *Server) rateLimited(method string) (int, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	queued := s.rateLimits[method]
+	if len(queued) == 0 {
+		return 0, false
+	}
+	s.rateLimits[method] = queued[1:]
+	return queued[0], true
+}
+
+// Reactions returns every reaction added so far, in order
+func (s *Server) Reactions() []Reaction {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Reaction(nil), s.reactions...)
+}
+
+// Posts returns every message posted so far, in order
+func (s *Server) Posts() []Post {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Post(nil), s.posts...)
+}
+
+// apiHandler handles a request authenticated as the given user and returns the response fields
+// to send along with "ok", or a slack error code
+type apiHandler func(userID string, req *http.Request) (map[string]interface{}, string)
+
+func writeJSON(resp http.ResponseWriter, body interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(body)
+}
+
+// authenticated checks the token of a request and renders the handler result the way slack does,
+// errors are reported with a 200 status and "ok": false
+func (s *Server) authenticated(handler apiHandler) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			writeJSON(resp, map[string]interface{}{"ok": false, "error": "invalid_form_data"})
+			return
+		}
+		token := req.Form.Get("token")
+		if token == "" {
+			writeJSON(resp, map[string]interface{}{"ok": false, "error": "not_authed"})
+			return
+		}
+		s.lock.Lock()
+		userID, ok := s.identities[token]
+		s.lock.Unlock()
+		if !ok {
+			writeJSON(resp, map[string]interface{}{"ok": false, "error": "invalid_auth"})
+			return
+		}
+		if retryAfter, limited := s.rateLimited(strings.TrimPrefix(req.URL.Path, "/")); limited {
+			resp.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			resp.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		result, slackErr := handler(userID, req)
+		if slackErr != "" {
+			writeJSON(resp, map[string]interface{}{"ok": false, "error": slackErr})
+			return
+		}
+		if result == nil {
+			result = make(map[string]interface{})
+		}
+		result["ok"] = true
+		writeJSON(resp, result)
+	}
+}
+
+func (s *Server) handleAuthTest(userID string, req *http.Request) (map[string]interface{}, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return map[string]interface{}{
+		"user_id": userID,
+		"user":    s.users[userID].Name,
+		"team_id": s.TeamID,
+		"team":    "test",
+		"url":     s.server.URL + "/",
+	}, ""
+}
+
+func (s *Server) handleUsersList(userID string, req *http.Request) (map[string]interface{}, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids := make([]string, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	limit, _ := strconv.Atoi(req.Form.Get("limit"))
+	if limit <= 0 {
+		limit = len(ids)
+	}
+	start, _ := strconv.Atoi(req.Form.Get("cursor"))
+	if start > len(ids) {
+		return nil, "invalid_cursor"
+	}
+	end := start + limit
+	next := strconv.Itoa(end)
+	if end >= len(ids) {
+		end, next = len(ids), ""
+	}
+
+	members := make([]slack.User, 0, end-start)
+	for _, id := range ids[start:end] {
+		members = append(members, s.users[id])
+	}
+	return map[string]interface{}{
+		"members":           members,
+		"response_metadata": map[string]string{"next_cursor": next},
+	}, ""
+}
+
+func (s *Server) handleUsersInfo(userID string, req *http.Request) (map[string]interface{}, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := req.Form.Get("user")
+	user, ok := s.users[id]
+	if !ok && s.Permissive && id != "" {
+		user = slack.User{ID: id, Name: strings.ToLower(id), TeamID: s.TeamID, RealName: id}
+		s.users[id] = user
+	} else if !ok {
+		return nil, "user_not_found"
+	}
+	return map[string]interface{}{"user": user}, ""
+}
+
+func (s *Server) handleReactionsAdd(userID string, req *http.Request) (map[string]interface{}, string) {
+	reaction := Reaction{
+		Name:      req.Form.Get("name"),
+		Channel:   req.Form.Get("channel"),
+		Timestamp: req.Form.Get("timestamp"),
+	}
+	if reaction.Name == "" {
+		return nil, "invalid_name"
+	}
+	if reaction.Channel == "" || reaction.Timestamp == "" {
+		return nil, "bad_timestamp"
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, existing := range s.reactions {
+		if existing == reaction {
+			return nil, "already_reacted"
+		}
+	}
+	s.reactions = append(s.reactions, reaction)
+	return nil, ""
+}
+
+func (s *Server) handleFilesSharedPublicURL(userID string, req *http.Request) (map[string]interface{}, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	file, ok := s.files[req.Form.Get("file")]
+	if !ok && s.Permissive {
+		id := req.Form.Get("file")
+		file = slack.File{
+			ID:                 id,
+			Name:               id,
+			URLPrivateDownload: fmt.Sprintf("https://files.slack.com/files-pri/%s-%s/download/%s", s.TeamID, id, id),
+		}
+	} else if !ok {
+		return nil, "file_not_found"
+	}
+	// Public permalinks end with the secret that unlocks the private download URL
+	file.PublicURLShared = true
+	file.PermalinkPublic = fmt.Sprintf("https://slack-files.com/%s-%s-%x", s.TeamID, file.ID, len(file.ID)*7919)
+	s.files[file.ID] = file
+	return map[string]interface{}{"file": file}, ""
+}
+
+func (s *Server) handleChatPostMessage(userID string, req *http.Request) (map[string]interface{}, string) {
+	post := Post{
+		Channel:  req.Form.Get("channel"),
+		Text:     req.Form.Get("text"),
+		ThreadTS: req.Form.Get("thread_ts"),
+	}
+	if post.Channel == "" {
+		return nil, "channel_not_found"
+	}
+	if post.Text == "" {
+		return nil, "no_text"
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sequence++
+	ts := fmt.Sprintf("%d.%06d", 1500000000+s.sequence, s.sequence)
+	s.posts = append(s.posts, post)
+	msg := slack.Message{}
+	msg.Type = "message"
+	msg.User = userID
+	msg.Text = post.Text
+	msg.Timestamp = ts
+	msg.ThreadTimestamp = post.ThreadTS
+	s.history[post.Channel] = append(s.history[post.Channel], msg)
+	return map[string]interface{}{"channel": post.Channel, "ts": ts, "message": msg}, ""
+}
+
+func (s *Server) handleChatGetPermalink(userID string, req *http.Request) (map[string]interface{}, string) {
+	channel, ts := req.Form.Get("channel"), req.Form.Get("message_ts")
+	if channel == "" {
+		return nil, "channel_not_found"
+	}
+	if ts == "" {
+		return nil, "message_not_found"
+	}
+	link := fmt.Sprintf("%s/archives/%s/p%s", s.server.URL, channel, strings.Replace(ts, ".", "", 1))
+	return map[string]interface{}{"channel": channel, "permalink": link}, ""
+}
+
+// handleFileDownload serves the private download URLs of files added with AddFileData. Like slack
+// it wants the token as a bearer token rather than a form value.
+func (s *Server) handleFileDownload(resp http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	s.lock.Lock()
+	_, authed := s.identities[token]
+	var data []byte
+	found := false
+	for id, file := range s.files {
+		if req.URL.String() == strings.TrimPrefix(file.URLPrivateDownload, s.server.URL) {
+			data, found = s.fileData[id]
+		}
+	}
+	s.lock.Unlock()
+	switch {
+	case !authed:
+		http.Error(resp, "not authorized", http.StatusForbidden)
+	case !found:
+		http.NotFound(resp, req)
+	default:
+		resp.Write(data)
+	}
+}
+
+// handleConversationsHistory only supports what GetMessage needs, fetching a single message by
+// passing its timestamp as latest with inclusive set
+func (s *Server) handleConversationsHistory(userID string, req *http.Request) (map[string]interface{}, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	messages, ok := s.history[req.Form.Get("channel")]
+	if !ok && !s.Permissive {
+		return nil, "channel_not_found"
+	}
+	latest := req.Form.Get("latest")
+	found := []slack.Message{}
+	for index := len(messages) - 1; index >= 0; index-- {
+		// Like slack, the history only has top level messages
+		if thread := messages[index].ThreadTimestamp; thread != "" && thread != messages[index].Timestamp {
+			continue
+		}
+		if latest == "" || messages[index].Timestamp == latest {
+			found = append(found, messages[index])
+			break
+		}
+	}
+	return map[string]interface{}{"messages": found, "has_more": false}, ""
+}
+
+func (s *Server) handleConversationsReplies(userID string, req *http.Request) (map[string]interface{}, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	messages, ok := s.history[req.Form.Get("channel")]
+	if !ok {
+		return nil, "channel_not_found"
+	}
+	thread := req.Form.Get("ts")
+	found := []slack.Message{}
+	for _, msg := range messages {
+		if msg.Timestamp == thread || msg.ThreadTimestamp == thread {
+			found = append(found, msg)
+		}
+	}
+	if len(found) == 0 {
+		return nil, "thread_not_found"
+	}
+	return map[string]interface{}{
+		"messages":          found,
+		"has_more":          false,
+		"response_metadata": map[string]string{"next_cursor": ""},
+	}, ""
+}
@@ -0,0 +1,165 @@
+// Package smtptest provides a minimal in-process SMTP server that records the mail it is sent, so
+// email delivery can be tested without network access. It offers neither STARTTLS nor AUTH.
+package smtptest
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Message is a mail accepted by the server
+type Message struct {
+	From string
+	To   []string
+	// Data is the message as sent after DATA, headers included
+	Data []byte
+}
+
+// Server is a fake SMTP server listening on localhost
+type Server struct {
+	listener net.Listener
+
+	lock     sync.Mutex
+	messages []Message
+	// failures is the number of upcoming messages to reject after DATA
+	failures int
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a fake SMTP server. Callers must Close it.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{listener: listener}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr is the host:port to configure as the SMTP server address
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting connections and waits for open ones to finish
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+// FailNext makes the server reject the next message with a 554 once its data was sent
+func (s *Server) FailNext() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures++
+}
+
+// Messages returns every message accepted so far, in order
+func (s *Server) Messages() []Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// handle speaks just enough SMTP for net/smtp to deliver mail
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost smtptest ready")
+
+	var msg Message
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if index := strings.IndexByte(line, ' '); index >= 0 {
+			verb, arg = line[:index], line[index+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			msg = Message{}
+			text.PrintfLine("250 localhost")
+		case "MAIL":
+			msg = Message{From: addressOf(arg)}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if msg.From == "" {
+				text.PrintfLine("503 need MAIL before RCPT")
+				continue
+			}
+			msg.To = append(msg.To, addressOf(arg))
+			text.PrintfLine("250 OK")
+		case "DATA":
+			if len(msg.To) == 0 {
+				text.PrintfLine("503 need RCPT before DATA")
+				continue
+			}
+			text.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Data = data
+			if s.accept(msg) {
+				text.PrintfLine("250 OK")
+			} else {
+				text.PrintfLine("554 message rejected")
+			}
+			msg = Message{}
+		case "RSET":
+			msg = Message{}
+			text.PrintfLine("250 OK")
+		case "NOOP":
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+// accept records msg unless a failure was scripted for it
+func (s *Server) accept(msg Message) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return false
+	}
+	s.messages = append(s.messages, msg)
+	return true
+}
+
+// addressOf extracts the address from a "FROM:<a@b>" or "TO:<a@b>" argument
+func addressOf(arg string) string {
+	if index := strings.IndexByte(arg, ':'); index >= 0 {
+		arg = arg[index+1:]
+	}
+	if index := strings.IndexByte(arg, ' '); index >= 0 {
+		arg = arg[:index]
+	}
+	return strings.Trim(arg, "<>")
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DemandStatus tracks where a demand is in its lifecycle
+type DemandStatus string
+
+const (
+	// DemandQueued demands are waiting on the rate limiter or are being sent
+	DemandQueued DemandStatus = "queued"
+	// DemandSent demands have been accepted by twilio
+	DemandSent DemandStatus = "sent"
+	// DemandFailed demands could not be delivered
+	DemandFailed DemandStatus = "failed"
+	// DemandCancelled demands were deleted in slack before they were sent
+	DemandCancelled DemandStatus = "cancelled"
+	// DemandRecalled demands were deleted in slack after they were sent
+	DemandRecalled DemandStatus = "recalled"
+	// DemandDiscarded demands failed and were given up on from the admin console
+	DemandDiscarded DemandStatus = "discarded"
+)
+
+// DemandRecord is what we remember about a demand so later edits and deletions of the originating
+// slack message can be applied to it
+type DemandRecord struct {
+	// ID is a short sequential number the Dan uses to refer to the demand over SMS
+	ID        int          `json:"id"`
+	Channel   string       `json:"channel"`
+	TimeStamp string       `json:"ts"`
+	Sender    string       `json:"sender"`
+	Text      string       `json:"text"`
+	Status    DemandStatus `json:"status"`
+	CreatedAt time.Time    `json:"created_at"`
+	SentAt    time.Time    `json:"sent_at,omitempty"`
+	// Via is the channel the demand was delivered over, follow-ups like corrections use it too
+	Via string `json:"via,omitempty"`
+
+	// Escalated is set once a voice call has been placed for the demand
+	Escalated      bool      `json:"escalated,omitempty"`
+	CallSID        string    `json:"call_sid,omitempty"`
+	AcknowledgedAt time.Time `json:"acknowledged_at,omitempty"`
+
+	// Resolution is set once the Dan closes the demand, an empty resolution means it is still open
+	Resolution Resolution `json:"resolution,omitempty"`
+	Reminded   bool       `json:"reminded,omitempty"`
+
+	// cancel aborts an in-flight send, it is only set while the demand is queued
+	cancel context.CancelFunc
+}
+
+// Resolution is how the Dan closed a demand
+type Resolution string
+
+const (
+	ResolutionDone     Resolution = "done"
+	ResolutionDeclined Resolution = "declined"
+)
+
+// Key uniquely identifies the slack message a record was created from
+func (dr *DemandRecord) Key() string {
+	return dr.Channel + "/" + dr.TimeStamp
+}
+
+// refCode formats a demand ID as the reference included in the SMS
+func refCode(id int) string {
+	return fmt.Sprintf("#D%d", id)
+}
+
+// RefCode is the reference included in the SMS so the Dan can reply about this demand
+func (dr *DemandRecord) RefCode() string {
+	return refCode(dr.ID)
+}
+
+// Open reports whether the demand reached the Dan and has not been closed yet
+func (dr *DemandRecord) Open() bool {
+	return dr.Status == DemandSent && dr.Resolution == ""
+}
+
+// storeSnapshot is the on-disk form of a DemandStore
+type storeSnapshot struct {
+	// LastID is the last ID handed out, it is kept so IDs are not reused once the demands that
+	// had them are pruned
+	LastID  int             `json:"last_id"`
+	Demands []*DemandRecord `json:"demands"`
+	// LastInbound is when each address last messaged us, for as long as its session window lasts
+	LastInbound map[string]time.Time `json:"last_inbound,omitempty"`
+}
+
+// DemandStore keeps track of every recent demand keyed by its originating slack message. If a path
+// is given the store is persisted there as JSON after every change so the mapping survives
+// restarts.
+type DemandStore struct {
+	path      string
+	retention time.Duration
+
+	lock    sync.Mutex
+	records map[string]*DemandRecord
+	// lastID only ever grows, even when the newest records are pruned
+	lastID int
+	// lastInbound is when each address last messaged us
+	lastInbound map[string]time.Time
+	// generation counts the snapshots taken by save
+	generation int
+
+	// writeLock serializes writes of the state file, which happen outside of lock
+	writeLock sync.Mutex
+	// written is the generation of the snapshot on disk
+	written int
+}
+
+func NewDemandStore(path string, retention time.Duration) (*DemandStore, error) {
+	ds := &DemandStore{
+		path:        path,
+		retention:   retention,
+		records:     make(map[string]*DemandRecord),
+		lastInbound: make(map[string]time.Time),
+	}
+	if path == "" {
+		return ds, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ds, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read demand store: ")
+	}
+
+	var snapshot storeSnapshot
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		// State files written before the snapshot had a counter are a bare list of records
+		err = json.Unmarshal(data, &snapshot.Demands)
+	} else {
+		err = json.Unmarshal(data, &snapshot)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal demand store: ")
+	}
+	ds.lastID = snapshot.LastID
+	for addr, at := range snapshot.LastInbound {
+		ds.lastInbound[addr] = at
+	}
+	for _, rec := range snapshot.Demands {
+		// Anything in flight when we stopped is gone for good
+		if rec.Status == DemandQueued {
+			rec.Status = DemandFailed
+		}
+		ds.records[rec.Key()] = rec
+		if rec.ID > ds.lastID {
+			ds.lastID = rec.ID
+		}
+	}
+	logger.WithFields(logrus.Fields{"demands": len(ds.records), "path": path}).Info("loaded demand store")
+	return ds, nil
+}
+
+// save prunes expired records and takes a snapshot of the store for persist. The caller must hold
+// the lock.
+func (ds *DemandStore) save() (int, []byte) {
+	now := time.Now()
+	records := make([]*DemandRecord, 0, len(ds.records))
+	for key, rec := range ds.records {
+		if rec.Status != DemandQueued && now.Sub(rec.CreatedAt) > ds.retention {
+			delete(ds.records, key)
+			continue
+		}
+		records = append(records, rec)
+	}
+	for addr, at := range ds.lastInbound {
+		if now.Sub(at) > whatsappSessionWindow {
+			delete(ds.lastInbound, addr)
+		}
+	}
+	if ds.path == "" {
+		return 0, nil
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	data, err := json.Marshal(storeSnapshot{LastID: ds.lastID, Demands: records, LastInbound: ds.lastInbound})
+	if err != nil {
+		logger.WithError(err).Error("failed to marshal demand store")
+		return 0, nil
+	}
+	ds.generation++
+	return ds.generation, data
+}
+
+// persist writes a snapshot taken by save to disk unless a newer one was written already. It is
+// called without the lock so lookups are not stuck behind the disk.
+func (ds *DemandStore) persist(generation int, data []byte) {
+	if data == nil {
+		return
+	}
+	ds.writeLock.Lock()
+	defer ds.writeLock.Unlock()
+	if generation <= ds.written {
+		return
+	}
+	if err := writeFileAtomic(ds.path, data); err != nil {
+		logger.WithError(err).Error("failed to persist demand store")
+		return
+	}
+	ds.written = generation
+}
+
+// Add inserts a new record, replacing any existing record for the same slack message, and assigns
+// it the next ID.
+func (ds *DemandStore) Add(rec *DemandRecord) int {
+	ds.lock.Lock()
+	ds.lastID++
+	id := ds.lastID
+	rec.ID = id
+	ds.records[rec.Key()] = rec
+	generation, data := ds.save()
+	ds.lock.Unlock()
+	ds.persist(generation, data)
+	return id
+}
+
+// Get returns a copy of the record for the given key
+func (ds *DemandStore) Get(key string) (DemandRecord, bool) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	rec, ok := ds.records[key]
+	if !ok {
+		return DemandRecord{}, false
+	}
+	return *rec, true
+}
+
+// Lookup returns a copy of the record with the given ID
+func (ds *DemandStore) Lookup(id int) (DemandRecord, bool) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	for _, rec := range ds.records {
+		if rec.ID == id {
+			return *rec, true
+		}
+	}
+	return DemandRecord{}, false
+}
+
+// Update applies fn to the record for the given key and persists the result. It returns false if
+// there is no such record.
+func (ds *DemandStore) Update(key string, fn func(rec *DemandRecord)) bool {
+	ds.lock.Lock()
+	rec, ok := ds.records[key]
+	if !ok {
+		ds.lock.Unlock()
+		return false
+	}
+	fn(rec)
+	generation, data := ds.save()
+	ds.lock.Unlock()
+	ds.persist(generation, data)
+	return true
+}
+
+// List returns a copy of every record in the store, oldest first
+func (ds *DemandStore) List() []DemandRecord {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	records := make([]DemandRecord, 0, len(ds.records))
+	for _, rec := range ds.records {
+		records = append(records, *rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	return records
+}
+
+// NoteInbound records that an address messaged us at the given time
+func (ds *DemandStore) NoteInbound(from string, at time.Time) {
+	ds.lock.Lock()
+	ds.lastInbound[parseTwilioAddress(from).String()] = at
+	generation, data := ds.save()
+	ds.lock.Unlock()
+	ds.persist(generation, data)
+}
+
+// LastInbound returns when each address last messaged us within its session window
+func (ds *DemandStore) LastInbound() map[string]time.Time {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	lastInbound := make(map[string]time.Time, len(ds.lastInbound))
+	for addr, at := range ds.lastInbound {
+		lastInbound[addr] = at
+	}
+	return lastInbound
+}
+
+// Cancel aborts the send of a queued demand. It returns false if the demand is not queued.
+func (ds *DemandStore) Cancel(key string) bool {
+	ds.lock.Lock()
+	rec, ok := ds.records[key]
+	if !ok || rec.Status != DemandQueued {
+		ds.lock.Unlock()
+		return false
+	}
+	if rec.cancel != nil {
+		rec.cancel()
+		rec.cancel = nil
+	}
+	rec.Status = DemandCancelled
+	generation, data := ds.save()
+	ds.lock.Unlock()
+	ds.persist(generation, data)
+	return true
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it into place so
+// readers never observe a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file: ")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write temporary file: ")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to close temporary file: ")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), path), "failed to rename temporary file: ")
+}
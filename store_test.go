@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDemandIDsAreNotReusedAfterPruning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dan-demand")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "demands.json")
+
+	store, err := NewDemandStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	// Old enough to be pruned as soon as it is saved
+	store.Add(&DemandRecord{Channel: testChannel, TimeStamp: "1500000000.000100", Status: DemandSent, CreatedAt: time.Now().Add(-2 * time.Hour)})
+	if records := store.List(); len(records) != 0 {
+		t.Fatalf("expected the demand to be pruned, got %v", records)
+	}
+
+	store, err = NewDemandStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reload store: %v", err)
+	}
+	if id := store.Add(&DemandRecord{Channel: testChannel, TimeStamp: "1500000000.000200", CreatedAt: time.Now()}); id != 2 {
+		t.Errorf("expected the next demand to be #D2, got %s", refCode(id))
+	}
+}
+
+func TestLastInboundSurvivesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dan-demand")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "demands.json")
+
+	store, err := NewDemandStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	recent := time.Now().Add(-time.Hour).Round(0)
+	store.NoteInbound("whatsapp:+15555550100", recent)
+	// Outside the session window, so it is dropped on save
+	store.NoteInbound("whatsapp:+15555550199", time.Now().Add(-2*whatsappSessionWindow))
+
+	store, err = NewDemandStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reload store: %v", err)
+	}
+	lastInbound := store.LastInbound()
+	if len(lastInbound) != 1 || !lastInbound["whatsapp:+15555550100"].Equal(recent) {
+		t.Errorf("expected only the recent inbound to survive, got %v", lastInbound)
+	}
+}
+
+func TestConcurrentUpdatesPersistTheLatestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dan-demand")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "demands.json")
+
+	store, err := NewDemandStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.Add(&DemandRecord{Channel: testChannel, TimeStamp: fmt.Sprintf("1500000000.%06d", i), Status: DemandSent, CreatedAt: time.Now()})
+		}(i)
+	}
+	wg.Wait()
+
+	store, err = NewDemandStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to reload store: %v", err)
+	}
+	if records := store.List(); len(records) != 20 {
+		t.Errorf("expected every demand to be persisted, got %d", len(records))
+	}
+}
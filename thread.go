@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+)
+
+const (
+	// smsSegmentLength is the number of GSM-7 characters that fit in one segment of a
+	// concatenated SMS
+	smsSegmentLength = 153
+
+	threadContextPrefix = "> "
+	ellipsis            = "..."
+)
+
+// condense collapses all whitespace runs (including newlines) into single spaces
+func condense(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// truncate shortens text to at most limit bytes, marking it with an ellipsis when it was cut
+func truncate(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	if limit <= len(ellipsis) {
+		return ""
+	}
+	// Back off to the start of a rune so multi-byte characters are not split
+	cut := limit - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + ellipsis
+}
+
+// threadContext builds a condensed view of the thread a message was posted in: the parent message
+// followed by the most recent replies before it. The result never exceeds budget characters; the
+// parent is kept (truncated if necessary) and older replies are dropped first.
+func (e *Engine) threadContext(ctx context.Context, channel, threadTimestamp, timestamp string, budget int) (string, error) {
+	if budget <= 0 {
+		return "", nil
+	}
+	messages, err := e.slackWrapper.GetThreadReplies(ctx, channel, threadTimestamp)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to load thread: ")
+	}
+
+	var parent *slack.Message
+	var replies []slack.Message
+	for index := range messages {
+		msg := messages[index]
+		switch {
+		case msg.Timestamp == threadTimestamp:
+			parent = &messages[index]
+		case msg.Timestamp == timestamp:
+			// The message being relayed is sent on its own
+		default:
+			// Slack returns replies oldest first, so anything after our message is dropped
+			if msg.Timestamp < timestamp {
+				replies = append(replies, msg)
+			}
+		}
+	}
+	if limit := e.currentConfig().Demand.ThreadReplies; len(replies) > limit {
+		replies = replies[len(replies)-limit:]
+	}
+
+	var parentLine string
+	if parent != nil {
+		parentLine, err = e.threadLine(ctx, parent)
+		if err != nil {
+			return "", err
+		}
+		parentLine = truncate(parentLine, budget-1)
+		budget -= len(parentLine) + 1
+	}
+
+	// Walk backwards from the newest reply so the most relevant context survives the budget
+	var lines []string
+	for index := len(replies) - 1; index >= 0; index-- {
+		line, err := e.threadLine(ctx, &replies[index])
+		if err != nil {
+			return "", err
+		}
+		if len(line)+1 > budget {
+			break
+		}
+		budget -= len(line) + 1
+		lines = append([]string{line}, lines...)
+	}
+	if parentLine != "" {
+		lines = append([]string{parentLine}, lines...)
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// threadLine renders a single thread message as "> name: text"
+func (e *Engine) threadLine(ctx context.Context, msg *slack.Message) (string, error) {
+	name := msg.Username
+	if msg.User != "" {
+		var err error
+		name, err = e.slackWrapper.LookupUserName(ctx, msg.User)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to lookup username for '%s': ", msg.User)
+		}
+	}
+	return threadContextPrefix + name + ": " + condense(e.slackWrapper.ReplaceUIDs(msg.Text)), nil
+}
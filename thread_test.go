@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	cases := []struct {
+		text  string
+		limit int
+		want  string
+	}{
+		{"need coffee", 20, "need coffee"},
+		{"need coffee", 8, "need ..."},
+		{"need coffee", 3, ""},
+		// "é" is two bytes, cutting after the first would leave invalid UTF-8
+		{"café au lait", 7, "caf..."},
+		{"☕☕☕", 8, "☕..."},
+	}
+	for _, c := range cases {
+		got := truncate(c.text, c.limit)
+		if got != c.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", c.text, c.limit, got, c.want)
+		}
+		if len(got) > c.limit || !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q is not a valid cut", c.text, c.limit, got)
+		}
+	}
+}
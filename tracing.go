@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+
+	"contrib.go.opencensus.io/exporter/jaeger"
+	"contrib.go.opencensus.io/exporter/ocagent"
+	"github.com/pkg/errors"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
+)
+
+const (
+	traceExporterZPages  = "zpages"
+	traceExporterJaeger  = "jaeger"
+	traceExporterOCAgent = "ocagent"
+	traceExporterFile    = "file"
+
+	traceServiceName = "dan-demand"
+)
+
+// newTracedHTTPClient returns an http.Client whose requests are traced and carry the current span
+// to the server
+func newTracedHTTPClient() *http.Client {
+	return &http.Client{Transport: &ochttp.Transport{}}
+}
+
+// fileExporter writes every finished span to a file as a line of JSON
+type fileExporter struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newFileExporter(path string) (*fileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open trace file: ")
+	}
+	return &fileExporter{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (fe *fileExporter) ExportSpan(sd *trace.SpanData) {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	if err := fe.encoder.Encode(sd); err != nil {
+		logger.WithError(err).Error("failed to write span")
+	}
+}
+
+func (fe *fileExporter) Close() error {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	return fe.file.Close()
+}
+
+// setupTracing configures sampling and registers the configured trace exporter. The returned
+// function flushes and stops the exporter. Spans are always visible on /debug/tracez.
+func setupTracing(config *TracingConfig) (func(), error) {
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(config.SampleFraction)})
+
+	switch config.Exporter {
+	case traceExporterZPages:
+		return func() {}, nil
+	case traceExporterJaeger:
+		exporter, err := jaeger.NewExporter(jaeger.Options{
+			CollectorEndpoint: config.Endpoint,
+			Process:           jaeger.Process{ServiceName: traceServiceName},
+			OnError: func(err error) {
+				logger.WithError(err).Error("failed to export spans to jaeger")
+			},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create jaeger exporter: ")
+		}
+		trace.RegisterExporter(exporter)
+		return exporter.Flush, nil
+	case traceExporterOCAgent:
+		exporter, err := ocagent.NewExporter(
+			ocagent.WithInsecure(),
+			ocagent.WithAddress(config.Endpoint),
+			ocagent.WithServiceName(traceServiceName),
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create ocagent exporter: ")
+		}
+		trace.RegisterExporter(exporter)
+		return func() {
+			if err := exporter.Stop(); err != nil {
+				logger.WithError(err).Error("failed to stop ocagent exporter")
+			}
+		}, nil
+	case traceExporterFile:
+		exporter, err := newFileExporter(config.File)
+		if err != nil {
+			return nil, err
+		}
+		trace.RegisterExporter(exporter)
+		return func() {
+			if err := exporter.Close(); err != nil {
+				logger.WithError(err).Error("failed to close trace file")
+			}
+		}, nil
+	}
+	return nil, errors.Errorf("unknown trace exporter '%s'", config.Exporter)
+}
+
+// setSpanError marks the span as failed with the given error
+func setSpanError(span *trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+}
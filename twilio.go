@@ -2,36 +2,93 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/trace"
 	"golang.org/x/net/context/ctxhttp"
 )
 
-const baseURL = "https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json"
+// errRateLimited is returned when a demand could not acquire the rate limiter in time
+var errRateLimited = errors.New("rate limit hit")
 
 type TwilioClient struct {
-	accountSID  string
-	authToken   string
-	toNumber    string
-	fromNumber  string
-	smsEndpoint string
+	accountSID string
+	authToken  string
 
+	numberLock sync.RWMutex
+	// toNumber is the recipient's address, prefixed by its channel unless it is SMS
+	toNumber   string
+	fromNumber string
+	// whatsappFrom and rcsFrom send on their channels, the messaging service is used when empty
+	whatsappFrom string
+	rcsFrom      string
+	// templateSID is the content template sent to WhatsApp recipients outside the session window
+	templateSID string
+
+	sessionLock sync.Mutex
+	// lastInbound is when each address last messaged us
+	lastInbound map[string]time.Time
+
+	accountEndpoint string
+	smsEndpoint     string
+	callEndpoint    string
+
+	// messagingServiceSID sends SMS through a messaging service instead of from a number
+	messagingServiceSID string
+	// senders rate limits SMS, there is one per number in the from_numbers pool or a single one
+	// without a number of its own otherwise
+	senders []*twilioSender
+	// nextSender is where the search for an idle sender starts, so the pool is used round robin
+	nextSender uint32
+
+	client *http.Client
+	// retryBackoff is the wait before the first retry of a failed request
+	retryBackoff time.Duration
+}
+
+// twilioSender is a number SMS are sent from along with its rate limit
+type twilioSender struct {
+	// number is empty for the sender of a client without a from_numbers pool, which sends from
+	// from_number or through the messaging service
+	number  string
 	limiter *Limiter
-	client  *http.Client
 }
 
 type SendMessageParams struct {
 	Message  string
 	MediaURL *string
 	Chunked  bool
+	// Channel overrides the DeliveryChannel, e.g. to fall back to SMS
+	Channel string
+	// From pins the number of the pool the message is sent from, so every chunk of a demand comes
+	// from the same number. An empty From uses whichever number is free first.
+	From string
+	// StatusCallback receives the delivery updates of the message, it may be empty
+	StatusCallback string
+}
+
+// PlaceCallParams describes an outbound voice call to the Dan
+type PlaceCallParams struct {
+	// TwiML is the inline document twilio executes once the call is answered
+	TwiML string
+	// StatusCallback receives the final outcome of the call, it may be empty
+	StatusCallback string
 }
 
 func NewTwilioClient(config *TwilioConfig) (*TwilioClient, error) {
@@ -40,66 +97,338 @@ func NewTwilioClient(config *TwilioConfig) (*TwilioClient, error) {
 		return nil, errors.Wrapf(err, "failed to parse rate_limit duration '%s': ", config.Limit)
 	}
 
-	limiter := NewLimiter(limit)
+	var senders []*twilioSender
+	for _, number := range config.FromNumbers {
+		senders = append(senders, &twilioSender{number: number, limiter: NewLimiter(limit)})
+	}
+	if len(senders) == 0 {
+		senders = []*twilioSender{{limiter: NewLimiter(limit)}}
+	}
 
+	accountURL := strings.TrimRight(config.BaseURL, "/") + "/Accounts/" + config.SID + "/"
 	return &TwilioClient{
-		accountSID:  config.SID,
-		authToken:   config.Token,
-		toNumber:    config.ToNumber,
-		fromNumber:  config.FromNumber,
-		smsEndpoint: fmt.Sprintf(baseURL, config.SID),
-		limiter:     limiter,
-		client:      &http.Client{},
+		accountSID:          config.SID,
+		authToken:           config.Token,
+		toNumber:            config.ToNumber,
+		fromNumber:          config.FromNumber,
+		whatsappFrom:        config.WhatsAppFrom,
+		rcsFrom:             config.RCSFrom,
+		templateSID:         config.WhatsAppTemplateSID,
+		lastInbound:         make(map[string]time.Time),
+		accountEndpoint:     strings.TrimSuffix(accountURL, "/") + ".json",
+		smsEndpoint:         accountURL + "Messages.json",
+		callEndpoint:        accountURL + "Calls.json",
+		messagingServiceSID: config.MessagingServiceSID,
+		senders:             senders,
+		client:              newTracedHTTPClient(),
+		retryBackoff:        twilioRetryBackoff,
 	}, nil
 }
 
-func (tw *TwilioClient) SendMessage(ctx context.Context, params SendMessageParams) error {
-	data := url.Values{}
-	data.Set("To", tw.toNumber)
-	data.Set("From", tw.fromNumber)
-	data.Set("Body", params.Message)
-	if params.MediaURL != nil {
-		data.Set("MediaUrl", *params.MediaURL)
+// numbers returns the current recipient and sender numbers
+func (tw *TwilioClient) numbers() (string, string) {
+	tw.numberLock.RLock()
+	defer tw.numberLock.RUnlock()
+	return tw.toNumber, tw.fromNumber
+}
+
+// SetNumbers swaps the recipient and sender addresses used for new messages and calls
+func (tw *TwilioClient) SetNumbers(config *TwilioConfig) {
+	tw.numberLock.Lock()
+	defer tw.numberLock.Unlock()
+	tw.toNumber = config.ToNumber
+	tw.fromNumber = config.FromNumber
+	tw.whatsappFrom = config.WhatsAppFrom
+	tw.rcsFrom = config.RCSFrom
+	tw.templateSID = config.WhatsAppTemplateSID
+}
+
+// Recipient returns the address demands are currently sent to
+func (tw *TwilioClient) Recipient() string {
+	to, _ := tw.numbers()
+	return to
+}
+
+// callerNumber returns the number voice calls are placed from. Messaging services cannot place
+// calls, so without a from_number the first number of the pool is used.
+func (tw *TwilioClient) callerNumber() string {
+	_, from := tw.numbers()
+	if from == "" {
+		from = tw.senders[0].number
 	}
-	req, err := http.NewRequest("POST", tw.smsEndpoint, strings.NewReader(data.Encode()))
-	if err != nil {
-		return errors.Wrap(err, "failed to construct request: ")
+	return from
+}
+
+// CanCall reports whether there is a number to place voice calls from
+func (tw *TwilioClient) CanCall() bool {
+	return tw.callerNumber() != ""
+}
+
+// Limit returns the minimum interval between SMS sent from a single number
+func (tw *TwilioClient) Limit() time.Duration {
+	return tw.senders[0].limiter.Limit()
+}
+
+// SetLimit changes the minimum interval between SMS sent from a single number
+func (tw *TwilioClient) SetLimit(limit time.Duration) {
+	for _, sender := range tw.senders {
+		sender.limiter.SetLimit(limit)
+	}
+}
+
+// Stop stops the rate limiters of every sender
+func (tw *TwilioClient) Stop() {
+	for _, sender := range tw.senders {
+		sender.limiter.Stop()
+	}
+}
+
+// acquire waits for a sender to be allowed to send, the pinned number if it is part of the pool or
+// otherwise whichever sender is free first. It returns false if ctx expired while waiting.
+func (tw *TwilioClient) acquire(ctx context.Context, pinned string) (*twilioSender, bool) {
+	for _, sender := range tw.senders {
+		if pinned != "" && sender.number == pinned {
+			return sender, sender.limiter.Acquire(ctx)
+		}
+	}
+	if len(tw.senders) == 1 {
+		return tw.senders[0], tw.senders[0].limiter.Acquire(ctx)
+	}
+
+	start := int(atomic.AddUint32(&tw.nextSender, 1))
+	order := make([]*twilioSender, len(tw.senders))
+	for i := range order {
+		order[i] = tw.senders[(start+i)%len(tw.senders)]
+		if order[i].limiter.TryAcquire() {
+			return order[i], true
+		}
 	}
 
+	// Every number is busy, wait on all of them at once
+	cases := make([]reflect.SelectCase, 0, len(order)+1)
+	for _, sender := range order {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(sender.limiter.throttle)})
+	}
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+	chosen, _, _ := reflect.Select(cases)
+	if chosen == len(order) {
+		return order[0], false
+	}
+	return order[chosen], true
+}
+
+// post sends an authenticated form request to the twilio API and decodes the JSON response. name
+// identifies the endpoint in metrics. Requests twilio refused with a retryable error are retried
+// with backoff as long as ctx allows, each retry first waits on limiter unless it is nil.
+func (tw *TwilioClient) post(ctx context.Context, name, endpoint string, data url.Values, limiter *Limiter) (map[string]interface{}, error) {
+	var err error
+	for attempt := 1; attempt <= twilioMaxAttempts; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequest("POST", endpoint, strings.NewReader(data.Encode()))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to construct request: ")
+		}
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		var respMap map[string]interface{}
+		respMap, err = tw.do(ctx, name, req)
+		twErr, ok := asTwilioError(err)
+		if !ok || twErr.Class() != twilioRetryable || attempt == twilioMaxAttempts {
+			return respMap, err
+		}
+
+		wait := twilioBackoff(tw.retryBackoff, attempt, twErr.RetryAfter)
+		loggerFrom(ctx).WithError(err).WithFields(logrus.Fields{
+			"endpoint": name,
+			"attempt":  attempt,
+			"wait":     wait.String(),
+		}).Warning("twilio request failed, retrying")
+		if !sleepContext(ctx, wait) || (limiter != nil && !limiter.Acquire(ctx)) {
+			return nil, errors.Wrapf(err, "gave up retrying after %d attempts: ", attempt)
+		}
+	}
+	return nil, err
+}
+
+// do authenticates and sends a request to the twilio API and decodes the JSON response
+func (tw *TwilioClient) do(ctx context.Context, name string, req *http.Request) (map[string]interface{}, error) {
 	req.SetBasicAuth(tw.accountSID, tw.authToken)
 	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	if acquired := tw.limiter.Acquire(ctx); params.Chunked || acquired {
-		resp, err := ctxhttp.Do(ctx, tw.client, req)
+	start := time.Now()
+	resp, err := ctxhttp.Do(ctx, tw.client, req)
+	if err != nil {
+		recordTwilioCall(ctx, name, start, 0)
+		return nil, errors.Wrap(err, "failed to make twilio request: ")
+	}
+	defer resp.Body.Close()
+	recordTwilioCall(ctx, name, start, resp.StatusCode)
+	trace.FromContext(ctx).AddAttributes(trace.Int64Attribute("twilio.status_code", int64(resp.StatusCode)))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		var respMap map[string]interface{}
+		decoder := json.NewDecoder(resp.Body)
+		err := decoder.Decode(&respMap)
 		if err != nil {
-			return errors.Wrap(err, "failed to make twilio request: ")
+			return nil, errors.Wrap(err, "failed to decode response from twilio: ")
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			var respMap map[string]interface{}
-			decoder := json.NewDecoder(resp.Body)
-			err := decoder.Decode(&respMap)
-			if err != nil {
-				return errors.Wrap(err, "failed to decode response from twilio: ")
-			}
-			glog.V(2).Infof(
-				"message queued from: %s size: %d mms: %t segments: %s status: %v",
-				strings.Split(params.Message, ":")[0],
-				len(params.Message),
-				params.MediaURL != nil,
-				respMap["num_segments"],
-				respMap["status"],
-			)
-		} else {
-			data, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				return errors.Wrap(err, "twilio request failed and failed to read error body: ")
+		return respMap, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "twilio request failed and failed to read error body: ")
+	}
+	twErr := newTwilioError(resp, body)
+	trace.FromContext(ctx).AddAttributes(trace.Int64Attribute("twilio.error_code", int64(twErr.Code)))
+	if twErr.Class() == twilioConfig {
+		loggerFrom(ctx).WithError(twErr).Error("twilio rejected our request, check the twilio settings")
+	}
+	return nil, twErr
+}
+
+// SendMessage texts the Dan and returns the number of the pool the message was sent from, which
+// is empty without a from_numbers pool. WhatsApp messages outside the session window are sent as
+// the configured template.
+func (tw *TwilioClient) SendMessage(ctx context.Context, params SendMessageParams) (string, error) {
+	channel := params.Channel
+	if channel == "" {
+		channel = tw.DeliveryChannel()
+	}
+	tw.numberLock.RLock()
+	recipient := parseTwilioAddress(tw.toNumber)
+	from, whatsappFrom, rcsFrom, templateSID := tw.fromNumber, tw.whatsappFrom, tw.rcsFrom, tw.templateSID
+	tw.numberLock.RUnlock()
+	to := recipient.On(channel)
+	templated := !tw.inSession(to)
+	if templated && templateSID == "" {
+		return "", errNoSession
+	}
+
+	waitStart := time.Now()
+	_, waitSpan := trace.StartSpan(ctx, "twilio.LimiterWait")
+	sender, acquired := tw.acquire(ctx, params.From)
+	waitSpan.AddAttributes(trace.BoolAttribute("acquired", acquired))
+	waitSpan.End()
+	stats.Record(ctx, mLimiterWait.M(sinceMillis(waitStart)))
+
+	data := url.Values{}
+	data.Set("To", to.String())
+	switch {
+	case channel == channelWhatsApp && whatsappFrom != "":
+		data.Set("From", twilioAddress{Channel: channelWhatsApp, Number: whatsappFrom}.String())
+	case channel == channelRCS && rcsFrom != "":
+		data.Set("From", twilioAddress{Channel: channelRCS, Number: rcsFrom}.String())
+	case channel == channelSMS && sender.number != "":
+		data.Set("From", sender.number)
+	case tw.messagingServiceSID != "":
+		data.Set("MessagingServiceSid", tw.messagingServiceSID)
+	default:
+		data.Set("From", from)
+	}
+	if params.StatusCallback != "" {
+		data.Set("StatusCallback", params.StatusCallback)
+	}
+	if templated {
+		// Templates have a fixed layout, the demand goes into its variable and media is dropped
+		vars, err := templateVariables(params.Message)
+		if err != nil {
+			return sender.number, err
+		}
+		data.Set("ContentSid", templateSID)
+		data.Set("ContentVariables", vars)
+	} else {
+		data.Set("Body", params.Message)
+		if params.MediaURL != nil {
+			data.Set("MediaUrl", *params.MediaURL)
+		}
+	}
+	if params.Chunked || acquired {
+		respMap, err := tw.post(ctx, "Messages", tw.smsEndpoint, data, sender.limiter)
+		if err != nil {
+			return sender.number, err
+		}
+		if segments, ok := respMap["num_segments"].(string); ok && channel == channelSMS {
+			if count, err := strconv.Atoi(segments); err == nil {
+				stats.Record(ctx, mSMSSegments.M(int64(count)))
+				trace.FromContext(ctx).AddAttributes(trace.Int64Attribute("twilio.segments", int64(count)))
 			}
-			return errors.New(fmt.Sprintf("twilio error received: %s", string(data)))
 		}
+		loggerFrom(ctx).WithFields(logrus.Fields{
+			"sid":      respMap["sid"],
+			"channel":  channel,
+			"template": templated,
+			"from":     respMap["from"],
+			"size":     len(params.Message),
+			"mms":      params.MediaURL != nil,
+			"segments": respMap["num_segments"],
+			"status":   respMap["status"],
+		}).Debug("message queued")
 	} else {
-		return errors.New("rate limit hit")
+		return sender.number, errRateLimited
 	}
 
+	return sender.number, nil
+}
+
+// CheckAccount verifies that our credentials work and the account is active
+func (tw *TwilioClient) CheckAccount(ctx context.Context) error {
+	req, err := http.NewRequest("GET", tw.accountEndpoint, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to construct request: ")
+	}
+	respMap, err := tw.do(ctx, "Account", req)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch twilio account: ")
+	}
+	if status, _ := respMap["status"].(string); status != "active" {
+		return errors.Errorf("twilio account is %s", status)
+	}
 	return nil
 }
+
+// PlaceCall starts a voice call to the Dan and returns the SID of the new call. Calls are not
+// subject to the SMS rate limit.
+func (tw *TwilioClient) PlaceCall(ctx context.Context, params PlaceCallParams) (string, error) {
+	data := url.Values{}
+	data.Set("To", parseTwilioAddress(tw.Recipient()).Number)
+	data.Set("From", tw.callerNumber())
+	data.Set("Twiml", params.TwiML)
+	if params.StatusCallback != "" {
+		data.Set("StatusCallback", params.StatusCallback)
+		data.Set("StatusCallbackMethod", "POST")
+	}
+	respMap, err := tw.post(ctx, "Calls", tw.callEndpoint, data, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to place call: ")
+	}
+	sid, _ := respMap["sid"].(string)
+	loggerFrom(ctx).WithFields(logrus.Fields{"sid": sid, "status": respMap["status"]}).Debug("call queued")
+	return sid, nil
+}
+
+// ValidateSignature checks the X-Twilio-Signature header of a webhook request. fullURL must be the
+// exact URL twilio was configured to call, including the query string. The request form must
+// already be parsed.
+func (tw *TwilioClient) ValidateSignature(req *http.Request, fullURL string) bool {
+	signature := req.Header.Get("X-Twilio-Signature")
+	if signature == "" {
+		return false
+	}
+
+	// Twilio signs the URL followed by every POST parameter sorted by name
+	keys := make([]string, 0, len(req.PostForm))
+	for key := range req.PostForm {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var payload strings.Builder
+	payload.WriteString(fullURL)
+	for _, key := range keys {
+		for _, val := range req.PostForm[key] {
+			payload.WriteString(key)
+			payload.WriteString(val)
+		}
+	}
+
+	mac := hmac.New(sha1.New, []byte(tw.authToken))
+	mac.Write([]byte(payload.String()))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
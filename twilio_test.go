@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"dan-demand/slacktest"
+	"dan-demand/twiliotest"
+)
+
+const (
+	testAccountSID = replayAccountSID
+	testAuthToken  = replayAuthToken
+	testToNumber   = replayToNumber
+	testFromNumber = replayFromNumber
+)
+
+func TestSendMessage(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	client, fake := env.engine.twilioClient, env.twilio
+
+	if _, err := client.SendMessage(context.Background(), SendMessageParams{Message: "alice: lunch?"}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	messages := fake.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	msg := messages[0]
+	if msg.To != testToNumber || msg.From != testFromNumber {
+		t.Errorf("expected %s -> %s, got %s -> %s", testFromNumber, testToNumber, msg.From, msg.To)
+	}
+	if msg.Body != "alice: lunch?" {
+		t.Errorf("unexpected body %q", msg.Body)
+	}
+	if len(msg.MediaURLs) != 0 {
+		t.Errorf("expected no media, got %v", msg.MediaURLs)
+	}
+}
+
+func TestSendMessageMedia(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	client, fake := env.engine.twilioClient, env.twilio
+
+	media := "https://files.slack.com/files-pri/T1-F1/cat.png?pub_secret=abc"
+	_, err := client.SendMessage(context.Background(), SendMessageParams{Message: "alice: look", MediaURL: &media})
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	messages := fake.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if got := messages[0].MediaURLs; len(got) != 1 || got[0] != media {
+		t.Errorf("expected media %q, got %v", media, got)
+	}
+}
+
+func TestMessagingServiceIgnoresEscalationKeyword(t *testing.T) {
+	env := newTestEnvWith(t, func(env *replayEnv, config *DanDemandConfig) {
+		config.Server.PublicURL = env.publicURL()
+		config.Twilio.FromNumber = ""
+		config.Twilio.MessagingServiceSID = "MG00000000000000000000000000000001"
+	})
+	defer env.Close()
+
+	env.inject(t, slacktest.MessageEvent(testChannel, "U00000001", "1500000000.000100", "<@"+testBotUID+"> need coffee !call"))
+	env.waitForReaction(t, "thumbsup", testChannel, "1500000000.000100")
+	env.waitForQuiet()
+	if calls := env.twilio.Calls(); len(calls) != 0 {
+		t.Errorf("expected no call without a number to call from, got %v", calls)
+	}
+	if posts := env.slack.Posts(); len(posts) != 0 {
+		t.Errorf("expected no escalation to be attempted, got %v", posts)
+	}
+}
+
+func TestSendMessageMessagingService(t *testing.T) {
+	env := newTestEnvWith(t, func(env *replayEnv, config *DanDemandConfig) {
+		config.Twilio.FromNumber = ""
+		config.Twilio.MessagingServiceSID = "MG00000000000000000000000000000001"
+	})
+	defer env.Close()
+	client, fake := env.engine.twilioClient, env.twilio
+
+	if _, err := client.SendMessage(context.Background(), SendMessageParams{Message: "alice: hi"}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	messages := fake.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if msg := messages[0]; msg.MessagingServiceSID != "MG00000000000000000000000000000001" || msg.From != "" {
+		t.Errorf("expected the message to go through the messaging service, got from %q service %q", msg.From, msg.MessagingServiceSID)
+	}
+}
+
+func TestSenderPool(t *testing.T) {
+	pool := []string{"+15555550201", "+15555550202"}
+	env := newTestEnvWith(t, func(env *replayEnv, config *DanDemandConfig) {
+		config.Twilio.FromNumbers = pool
+		config.Twilio.Limit = "20ms"
+	})
+	defer env.Close()
+	client, fake := env.engine.twilioClient, env.twilio
+
+	// Both numbers are free after the first tick, so back to back messages use different numbers
+	// instead of waiting on one
+	for i := 0; i < 2; i++ {
+		if _, err := client.SendMessage(context.Background(), SendMessageParams{Message: "alice: hi"}); err != nil {
+			t.Fatalf("SendMessage failed: %v", err)
+		}
+	}
+	messages := fake.Messages()
+	if len(messages) != 2 || messages[0].From == messages[1].From {
+		t.Fatalf("expected 2 messages from different numbers, got %v", messages)
+	}
+	for _, msg := range messages {
+		if msg.From != pool[0] && msg.From != pool[1] {
+			t.Errorf("expected a number from the pool, got %s", msg.From)
+		}
+	}
+
+	// Every chunk of a demand comes from the same number
+	engine := env.engine
+	if _, err := engine.sendChunks(context.Background(), strings.Repeat("a", 2*twilioMsgLimit+1), nil, ""); err != nil {
+		t.Fatalf("sendChunks failed: %v", err)
+	}
+	chunks := fake.Messages()[2:]
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	for _, chunk := range chunks[1:] {
+		if chunk.From != chunks[0].From {
+			t.Errorf("expected every chunk to come from %s, got %s", chunks[0].From, chunk.From)
+		}
+	}
+
+	// Calls are placed from the first number of the pool without a from_number
+	client.SetNumbers(&TwilioConfig{ToNumber: testToNumber})
+	if _, err := client.PlaceCall(context.Background(), PlaceCallParams{TwiML: "<Response/>"}); err != nil {
+		t.Fatalf("PlaceCall failed: %v", err)
+	}
+	if calls := fake.Calls(); len(calls) != 1 || calls[0].From != pool[0] {
+		t.Errorf("expected a call from %s, got %v", pool[0], calls)
+	}
+}
+
+func TestWhatsApp(t *testing.T) {
+	const (
+		whatsappTo   = "whatsapp:" + testToNumber
+		whatsappFrom = "+14155238886"
+		templateSID  = "HX00000000000000000000000000000001"
+	)
+	env := newTestEnvWith(t, func(env *replayEnv, config *DanDemandConfig) {
+		config.Twilio.ToNumber = whatsappTo
+		config.Twilio.WhatsAppFrom = whatsappFrom
+		config.Twilio.WhatsAppTemplateSID = templateSID
+	})
+	defer env.Close()
+	engine, fake := env.engine, env.twilio
+
+	// The Dan has not messaged us yet, so only the template can be sent
+	if _, err := engine.sendChunks(context.Background(), "alice: lunch?", nil, ""); err != nil {
+		t.Fatalf("sendChunks failed: %v", err)
+	}
+	messages := fake.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if msg := messages[0]; msg.ContentSID != templateSID || msg.ContentVariables != `{"1":"alice: lunch?"}` || msg.Body != "" {
+		t.Errorf("expected a template message, got %+v", msg)
+	}
+	if msg := messages[0]; msg.To != whatsappTo || msg.From != "whatsapp:"+whatsappFrom {
+		t.Errorf("expected whatsapp:%s -> %s, got %s -> %s", whatsappFrom, whatsappTo, msg.From, msg.To)
+	}
+
+	// Inside the session window long demands go out whole instead of in SMS sized chunks
+	engine.twilioClient.NoteInbound(whatsappTo, time.Now())
+	fake.OpenSession(whatsappTo)
+	text := strings.Repeat("a", 3000)
+	if _, err := engine.sendChunks(context.Background(), text, nil, ""); err != nil {
+		t.Fatalf("sendChunks failed: %v", err)
+	}
+	messages = fake.Messages()
+	if len(messages) != 2 || messages[1].Body != text || messages[1].ContentSID != "" {
+		t.Fatalf("expected the demand as a single free form message, got %d messages", len(messages))
+	}
+}
+
+func TestWhatsAppFallsBackToSMS(t *testing.T) {
+	env := newTestEnvWith(t, func(env *replayEnv, config *DanDemandConfig) {
+		config.Twilio.ToNumber = "whatsapp:" + testToNumber
+		config.Twilio.WhatsAppFrom = "+14155238886"
+	})
+	defer env.Close()
+	engine, fake := env.engine, env.twilio
+
+	// Without a template demands outside the session window are texted
+	if _, err := engine.sendChunks(context.Background(), "alice: lunch?", nil, ""); err != nil {
+		t.Fatalf("sendChunks failed: %v", err)
+	}
+	// twilio still considers the session closed, so the WhatsApp send fails and is texted instead
+	engine.twilioClient.NoteInbound("whatsapp:"+testToNumber, time.Now())
+	text := strings.Repeat("b", 2000)
+	sent, err := engine.sendChunks(context.Background(), text, nil, "")
+	if err != nil {
+		t.Fatalf("sendChunks failed: %v", err)
+	}
+	if sent != 2 {
+		t.Errorf("expected the demand to be texted in 2 chunks, got %d", sent)
+	}
+
+	messages := fake.Messages()
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 SMS, got %d", len(messages))
+	}
+	for _, msg := range messages {
+		if msg.To != testToNumber || msg.From != testFromNumber {
+			t.Errorf("expected an SMS %s -> %s, got %s -> %s", testFromNumber, testToNumber, msg.From, msg.To)
+		}
+	}
+	if messages[1].Body+messages[2].Body != text {
+		t.Errorf("expected the SMS chunks to reassemble into the demand")
+	}
+}
+
+func TestSendMessageErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		failure twiliotest.Error
+		class   twilioErrorClass
+		reason  string
+	}{
+		{"rate limited", twiliotest.RateLimited(), twilioRetryable, "twilio is rate limiting us"},
+		{"invalid number", twiliotest.InvalidNumber(testToNumber), twilioPermanent, "the Dan's phone number is not valid"},
+		{"unsubscribed", twiliotest.Unsubscribed(testToNumber), twilioPermanent, "the Dan has unsubscribed from our texts by replying STOP"},
+		{"server error", twiliotest.ServerError(), twilioUnknown, "twilio is having problems"},
+		{"service unavailable", twiliotest.ServiceUnavailable(), twilioRetryable, "twilio is having problems"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			defer env.Close()
+			client, fake := env.engine.twilioClient, env.twilio
+
+			for i := 0; i < twilioMaxAttempts; i++ {
+				fake.FailNext(test.failure)
+			}
+			_, err := client.SendMessage(context.Background(), SendMessageParams{Message: "alice: hi"})
+			if err == nil {
+				t.Fatal("expected SendMessage to fail")
+			}
+			twErr, ok := asTwilioError(err)
+			if !ok {
+				t.Fatalf("expected a twilio error, got %v", err)
+			}
+			if twErr.Code != test.failure.Code || twErr.Message != test.failure.Message {
+				t.Errorf("expected error %d %q, got %d %q", test.failure.Code, test.failure.Message, twErr.Code, twErr.Message)
+			}
+			if twErr.Class() != test.class {
+				t.Errorf("expected a %s error, got %s", test.class, twErr.Class())
+			}
+			if twErr.Reason() != test.reason {
+				t.Errorf("expected reason %q, got %q", test.reason, twErr.Reason())
+			}
+			if len(fake.Messages()) != 0 {
+				t.Errorf("expected no messages to be recorded")
+			}
+		})
+	}
+}
+
+func TestSendMessageRetries(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	client, fake := env.engine.twilioClient, env.twilio
+
+	fake.FailNext(twiliotest.RateLimited(), twiliotest.ServiceUnavailable())
+	if _, err := client.SendMessage(context.Background(), SendMessageParams{Message: "alice: hi"}); err != nil {
+		t.Fatalf("expected SendMessage to succeed after retrying, got %v", err)
+	}
+	if len(fake.Messages()) != 1 {
+		t.Errorf("expected 1 message, got %d", len(fake.Messages()))
+	}
+
+	// Permanent errors and server errors, after which the message may exist, are not retried, the
+	// next request goes through
+	for _, failure := range []twiliotest.Error{twiliotest.InvalidNumber(testToNumber), twiliotest.ServerError()} {
+		fake.FailNext(failure)
+		if _, err := client.SendMessage(context.Background(), SendMessageParams{Message: "alice: hi"}); err == nil {
+			t.Fatalf("expected SendMessage to fail with %q", failure.Message)
+		}
+		if len(fake.Messages()) != 1 {
+			t.Errorf("expected %q not to be retried, got %d messages", failure.Message, len(fake.Messages()))
+		}
+	}
+}
+
+func TestSendMessageBadCredentials(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	client := env.engine.twilioClient
+
+	client.authToken = "wrong"
+	_, err := client.SendMessage(context.Background(), SendMessageParams{Message: "alice: hi"})
+	if twErr, ok := asTwilioError(err); !ok || twErr.Class() != twilioConfig {
+		t.Fatalf("expected SendMessage to fail with a config error, got %v", err)
+	}
+	if err := client.CheckAccount(context.Background()); err == nil {
+		t.Fatal("expected CheckAccount to fail with bad credentials")
+	}
+}
+
+func TestSendChunks(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	engine, fake := env.engine, env.twilio
+
+	text := strings.Repeat("a", twilioMsgLimit) + strings.Repeat("b", twilioMsgLimit) + "ccc"
+	media := "https://example.com/cat.png"
+	sent, err := engine.sendChunks(context.Background(), text, &media, "")
+	if err != nil {
+		t.Fatalf("sendChunks failed: %v", err)
+	}
+	if sent != 3 {
+		t.Errorf("expected 3 chunks to be sent, got %d", sent)
+	}
+
+	messages := fake.Messages()
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(messages))
+	}
+	var joined string
+	for index, msg := range messages {
+		if len(msg.Body) > twilioMsgLimit {
+			t.Errorf("chunk %d is %d characters long", index, len(msg.Body))
+		}
+		if hasMedia := len(msg.MediaURLs) > 0; hasMedia != (index == 0) {
+			t.Errorf("chunk %d has media %v, only the first chunk should", index, msg.MediaURLs)
+		}
+		joined += msg.Body
+	}
+	if joined != text {
+		t.Errorf("chunks do not reassemble into the original text")
+	}
+}
+
+func TestSendChunksStopsOnError(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	engine, fake := env.engine, env.twilio
+
+	fake.FailNext(twiliotest.Error{}, twiliotest.InvalidNumber(testToNumber))
+	text := strings.Repeat("a", 3*twilioMsgLimit)
+	sent, err := engine.sendChunks(context.Background(), text, nil, "")
+	if err == nil {
+		t.Fatal("expected sendChunks to fail")
+	}
+	if sent != 1 {
+		t.Errorf("expected 1 chunk to be sent before the failure, got %d", sent)
+	}
+	if len(fake.Messages()) != 1 {
+		t.Errorf("expected the remaining chunks to be abandoned, got %d messages", len(fake.Messages()))
+	}
+}
+
+func TestCallStatusCallback(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	client, fake := env.engine.twilioClient, env.twilio
+
+	statuses := make(chan string, 1)
+	var callbackURL string
+	webhook := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("failed to parse callback: %v", err)
+		}
+		if !client.ValidateSignature(req, callbackURL) {
+			t.Errorf("status callback signature did not validate")
+		}
+		statuses <- req.PostForm.Get("CallStatus")
+		resp.WriteHeader(http.StatusNoContent)
+	}))
+	defer webhook.Close()
+	callbackURL = webhook.URL + voiceStatusPath + "?demand=C1%2F1.0"
+
+	sid, err := client.PlaceCall(context.Background(), PlaceCallParams{
+		TwiML:          "<Response/>",
+		StatusCallback: callbackURL,
+	})
+	if err != nil {
+		t.Fatalf("PlaceCall failed: %v", err)
+	}
+	resp, err := fake.FireStatusCallback(sid, "no-answer")
+	if err != nil {
+		t.Fatalf("failed to fire status callback: %v", err)
+	}
+	resp.Body.Close()
+	if status := <-statuses; status != "no-answer" {
+		t.Errorf("expected no-answer, got %q", status)
+	}
+}
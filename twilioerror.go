@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// twilioMaxAttempts bounds how many times a request that failed with a retryable error is tried
+	twilioMaxAttempts = 3
+	// twilioRetryBackoff is the wait before the first retry, it doubles with every attempt
+	twilioRetryBackoff = 500 * time.Millisecond
+)
+
+// Twilio error codes we treat specially, see https://www.twilio.com/docs/api/errors
+const (
+	twilioCodeAuthenticationFailed = 20003
+	twilioCodeTooManyRequests      = 20429
+	twilioCodeInvalidToNumber      = 21211
+	twilioCodeUnsubscribed         = 21610
+	twilioCodeCarrierFiltered      = 30007
+	twilioCodeOutsideSession       = 63016
+)
+
+// twilioErrorClass says what to do about a failed twilio request
+type twilioErrorClass string
+
+const (
+	// twilioRetryable errors are temporary and twilio refused the request, so it can be sent again
+	twilioRetryable twilioErrorClass = "retryable"
+	// twilioPermanent errors will fail the same way no matter how often the request is sent
+	twilioPermanent twilioErrorClass = "permanent"
+	// twilioConfig errors need an operator to fix the configuration
+	twilioConfig twilioErrorClass = "config"
+	// twilioUnknown errors are not retried, since we cannot tell whether the request went through
+	twilioUnknown twilioErrorClass = "unknown"
+)
+
+// twilioReasons are the human readable explanations of error codes shown in slack
+var twilioReasons = map[int]string{
+	twilioCodeAuthenticationFailed: "twilio rejected our credentials",
+	twilioCodeTooManyRequests:      "twilio is rate limiting us",
+	twilioCodeInvalidToNumber:      "the Dan's phone number is not valid",
+	twilioCodeUnsubscribed:         "the Dan has unsubscribed from our texts by replying STOP",
+	twilioCodeCarrierFiltered:      "the Dan's carrier filtered the text as spam",
+	twilioCodeOutsideSession:       "the Dan's WhatsApp session has expired",
+}
+
+// TwilioError is an error response from the twilio API
+type TwilioError struct {
+	// Status is the HTTP status code of the response
+	Status   int    `json:"status"`
+	Code     int    `json:"code"`
+	Message  string `json:"message"`
+	MoreInfo string `json:"more_info"`
+	// RetryAfter is how long twilio asked us to wait before retrying, zero if it did not say
+	RetryAfter time.Duration `json:"-"`
+}
+
+// newTwilioError decodes the error body of a failed twilio response. Bodies that are not twilio's
+// JSON errors, e.g. from a proxy in front of it, are kept as the message.
+func newTwilioError(resp *http.Response, body []byte) *TwilioError {
+	twErr := &TwilioError{}
+	if err := json.Unmarshal(body, twErr); err != nil || twErr.Message == "" {
+		twErr.Message = strings.TrimSpace(string(body))
+	}
+	twErr.Status = resp.StatusCode
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		twErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return twErr
+}
+
+func (te *TwilioError) Error() string {
+	if te.Code == 0 {
+		return fmt.Sprintf("twilio error received: %d %s", te.Status, te.Message)
+	}
+	return fmt.Sprintf("twilio error %d received: %s", te.Code, te.Message)
+}
+
+// Class returns what should be done about the error
+func (te *TwilioError) Class() twilioErrorClass {
+	switch te.Code {
+	case twilioCodeTooManyRequests:
+		return twilioRetryable
+	case twilioCodeInvalidToNumber, twilioCodeUnsubscribed, twilioCodeCarrierFiltered, twilioCodeOutsideSession:
+		return twilioPermanent
+	case twilioCodeAuthenticationFailed:
+		return twilioConfig
+	}
+	switch {
+	case te.Status == http.StatusTooManyRequests:
+		return twilioRetryable
+	// These come from twilio's edge before the request reached the API, anything else could come
+	// after the message or call was created and retrying it could reach the Dan twice
+	case te.Status == http.StatusBadGateway || te.Status == http.StatusServiceUnavailable ||
+		te.Status == http.StatusGatewayTimeout:
+		return twilioRetryable
+	case te.Status == http.StatusUnauthorized || te.Status == http.StatusForbidden:
+		return twilioConfig
+	}
+	return twilioUnknown
+}
+
+// Reason explains the error for people in slack
+func (te *TwilioError) Reason() string {
+	if reason, ok := twilioReasons[te.Code]; ok {
+		return reason
+	}
+	if te.Status >= 500 {
+		return "twilio is having problems"
+	}
+	if te.Message != "" {
+		return "twilio said: " + te.Message
+	}
+	return fmt.Sprintf("twilio responded with status %d", te.Status)
+}
+
+// newDeliveryError describes a message twilio accepted but could not deliver, which it only reports
+// in the message's status callback. Carrier errors like 30007 are never returned by the API itself.
+func newDeliveryError(status, errorCode string) *TwilioError {
+	code, _ := strconv.Atoi(errorCode)
+	return &TwilioError{Code: code, Message: "the message was " + status}
+}
+
+// asTwilioError returns the twilio error err was caused by, if any
+func asTwilioError(err error) (*TwilioError, bool) {
+	twErr, ok := errors.Cause(err).(*TwilioError)
+	return twErr, ok
+}
+
+// twilioBackoff is how long to wait before retry number attempt, counting from 1. twilio's
+// Retry-After wins when it is longer.
+func twilioBackoff(base time.Duration, attempt int, retryAfter time.Duration) time.Duration {
+	wait := base << uint(attempt-1)
+	// Jitter keeps the chunks of concurrent demands from retrying in lockstep
+	wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+	if retryAfter > wait {
+		wait = retryAfter
+	}
+	return wait
+}
@@ -0,0 +1,501 @@
+// Package twiliotest provides an in-process fake of the parts of the twilio REST API dan-demand
+// uses, so the twilio client can be tested without network access.
+package twiliotest
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// APIVersion is the path prefix of every twilio API endpoint
+	APIVersion = "/2010-04-01"
+
+	// maxBodyLength is the longest SMS body twilio accepts
+	maxBodyLength = 1600
+	// segmentLength is how many characters fit in a single concatenated SMS segment
+	segmentLength = 153
+)
+
+// Twilio error codes returned by the fake
+const (
+	CodeAuthenticationFailed = 20003
+	CodeTooManyRequests      = 20429
+	CodeInvalidToNumber      = 21211
+	CodeInvalidFromNumber    = 21212
+	CodeUnsubscribed         = 21610
+	CodeMissingBody          = 21602
+	CodeBodyTooLong          = 21617
+	CodeInternalError        = 20500
+	CodeCarrierFiltered      = 30007
+	CodeChannelNotFound      = 63007
+	CodeOutsideSession       = 63016
+)
+
+// channelBodyLengths is the longest body accepted on channels other than SMS
+var channelBodyLengths = map[string]int{
+	"whatsapp": 4096,
+	"rcs":      3072,
+}
+
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+// Error is a scripted failure, it is rendered the same way twilio renders API errors
+type Error struct {
+	Status  int    `json:"status"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// MoreInfo links to the twilio documentation of the error code
+	MoreInfo string `json:"more_info"`
+}
+
+// RateLimited is the error twilio returns when requests are sent too quickly
+func RateLimited() Error {
+	return Error{Status: http.StatusTooManyRequests, Code: CodeTooManyRequests, Message: "Too Many Requests"}
+}
+
+// InvalidNumber is the error twilio returns for a To number it cannot deliver to
+func InvalidNumber(number string) Error {
+	return Error{
+		Status:  http.StatusBadRequest,
+		Code:    CodeInvalidToNumber,
+		Message: fmt.Sprintf("The 'To' number %s is not a valid phone number.", number),
+	}
+}
+
+// Unsubscribed is the error twilio returns when the recipient replied STOP to the sender
+func Unsubscribed(number string) Error {
+	return Error{
+		Status:  http.StatusBadRequest,
+		Code:    CodeUnsubscribed,
+		Message: fmt.Sprintf("Attempt to send to unsubscribed recipient %s", number),
+	}
+}
+
+// ServerError is an unexpected failure inside twilio
+func ServerError() Error {
+	return Error{Status: http.StatusInternalServerError, Code: CodeInternalError, Message: "Internal Server Error"}
+}
+
+// ServiceUnavailable is the error twilio's edge returns when it could not pass the request on
+func ServiceUnavailable() Error {
+	return Error{Status: http.StatusServiceUnavailable, Message: "Service Unavailable"}
+}
+
+// Message is an SMS, MMS, WhatsApp or RCS message the fake accepted
+type Message struct {
+	SID  string
+	To   string
+	From string
+	// MessagingServiceSID is set instead of From for messages sent through a messaging service
+	MessagingServiceSID string
+	Body                string
+	// ContentSID and ContentVariables are set instead of Body for template messages
+	ContentSID       string
+	ContentVariables string
+	MediaURLs        []string
+	StatusCallback   string
+	Segments         int
+	// Form is the raw form the message was created from
+	Form url.Values
+}
+
+// Call is a voice call the fake accepted
+type Call struct {
+	SID            string
+	To             string
+	From           string
+	TwiML          string
+	StatusCallback string
+	Form           url.Values
+}
+
+// Server is a fake twilio API for a single account
+type Server struct {
+	AccountSID string
+	AuthToken  string
+
+	server *httptest.Server
+	// client delivers status callbacks
+	client *http.Client
+
+	lock     sync.Mutex
+	messages []Message
+	calls    []Call
+	failures []Error
+	sequence int
+	// sessions is when each WhatsApp address last messaged us
+	sessions map[string]time.Time
+}
+
+// NewServer starts a fake twilio API that only accepts requests authenticated with the given
+// credentials. Callers must Close it.
+func NewServer(accountSID, authToken string) *Server {
+	s := &Server{
+		AccountSID: accountSID,
+		AuthToken:  authToken,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		sessions:   make(map[string]time.Time),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// BaseURL is the value to configure as the twilio base URL
+func (s *Server) BaseURL() string {
+	return s.server.URL + APIVersion
+}
+
+// Messages returns every message accepted so far, in order
+func (s *Server) Messages() []Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Calls returns every call accepted so far, in order
+func (s *Server) Calls() []Call {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// FailNext scripts the outcome of the next len(errs) create requests, in order. A zero Error lets
+// its request through, so FailNext(Error{}, ServerError()) fails the second request.
+func (s *Server) FailNext(errs ...Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures = append(s.failures, errs...)
+}
+
+// nextFailure pops the next scripted failure, if any
+func (s *Server) nextFailure() (Error, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.failures) == 0 {
+		return Error{}, false
+	}
+	failure := s.failures[0]
+	s.failures = s.failures[1:]
+	return failure, failure.Status != 0
+}
+
+// nextSID generates a twilio style SID with the given two letter prefix
+func (s *Server) nextSID(prefix string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sequence++
+	return fmt.Sprintf("%s%032x", prefix, s.sequence)
+}
+
+func writeJSON(resp http.ResponseWriter, status int, body interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(body)
+}
+
+func writeError(resp http.ResponseWriter, err Error) {
+	if err.MoreInfo == "" {
+		err.MoreInfo = fmt.Sprintf("https://www.twilio.com/docs/errors/%d", err.Code)
+	}
+	writeJSON(resp, err.Status, err)
+}
+
+func (s *Server) serveHTTP(resp http.ResponseWriter, req *http.Request) {
+	user, password, ok := req.BasicAuth()
+	if !ok || user != s.AccountSID || password != s.AuthToken {
+		writeError(resp, Error{Status: http.StatusUnauthorized, Code: CodeAuthenticationFailed, Message: "Authenticate"})
+		return
+	}
+
+	accountPath := APIVersion + "/Accounts/" + s.AccountSID
+	switch {
+	case req.Method == "GET" && req.URL.Path == accountPath+".json":
+		writeJSON(resp, http.StatusOK, map[string]string{
+			"sid":    s.AccountSID,
+			"status": "active",
+		})
+	case req.Method == "POST" && req.URL.Path == accountPath+"/Messages.json":
+		s.createMessage(resp, req)
+	case req.Method == "POST" && req.URL.Path == accountPath+"/Calls.json":
+		s.createCall(resp, req)
+	default:
+		writeError(resp, Error{Status: http.StatusNotFound, Code: 20404, Message: "The requested resource was not found"})
+	}
+}
+
+// OpenSession records that a WhatsApp address messaged us, which allows free form messages to it
+// for 24 hours. PostWebhook does this for inbound messages.
+func (s *Server) OpenSession(address string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[address] = time.Now()
+}
+
+func (s *Server) inSession(address string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Since(s.sessions[address]) < 24*time.Hour
+}
+
+// splitAddress splits a channel address such as "whatsapp:+15555550100", plain numbers are SMS
+func splitAddress(address string) (string, string) {
+	if parts := strings.SplitN(address, ":", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return "sms", address
+}
+
+// validateAddresses checks the To and From fields of a message, which may be on any channel
+func validateAddresses(form url.Values) (Error, bool) {
+	toChannel, to := splitAddress(form.Get("To"))
+	if !e164Pattern.MatchString(to) {
+		return InvalidNumber(form.Get("To")), false
+	}
+	if form.Get("MessagingServiceSid") != "" {
+		// The service picks the sender itself
+		return Error{}, true
+	}
+	fromChannel, from := splitAddress(form.Get("From"))
+	if fromChannel != toChannel {
+		return Error{
+			Status:  http.StatusBadRequest,
+			Code:    CodeChannelNotFound,
+			Message: fmt.Sprintf("Twilio could not find a Channel with the specified From address %s", form.Get("From")),
+		}, false
+	}
+	// RCS senders are agent IDs rather than numbers
+	if from == "" || (fromChannel != "rcs" && !e164Pattern.MatchString(from)) {
+		return Error{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidFromNumber,
+			Message: fmt.Sprintf("The 'From' number %s is not a valid phone number.", form.Get("From")),
+		}, false
+	}
+	return Error{}, true
+}
+
+// validateNumbers checks the To and From fields shared by messages and calls
+func validateNumbers(form url.Values) (Error, bool) {
+	if to := form.Get("To"); !e164Pattern.MatchString(to) {
+		return InvalidNumber(to), false
+	}
+	if from := form.Get("From"); !e164Pattern.MatchString(from) {
+		return Error{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidFromNumber,
+			Message: fmt.Sprintf("The 'From' number %s is not a valid phone number.", from),
+		}, false
+	}
+	return Error{}, true
+}
+
+func (s *Server) createMessage(resp http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeError(resp, Error{Status: http.StatusBadRequest, Code: 20001, Message: err.Error()})
+		return
+	}
+	if failure, ok := s.nextFailure(); ok {
+		writeError(resp, failure)
+		return
+	}
+	form := req.PostForm
+	if failure, ok := validateAddresses(form); !ok {
+		writeError(resp, failure)
+		return
+	}
+	channel, _ := splitAddress(form.Get("To"))
+	body, media, content := form.Get("Body"), form["MediaUrl"], form.Get("ContentSid")
+	if body == "" && len(media) == 0 && content == "" {
+		writeError(resp, Error{Status: http.StatusBadRequest, Code: CodeMissingBody, Message: "Message body is required."})
+		return
+	}
+	if channel == "whatsapp" && content == "" && !s.inSession(form.Get("To")) {
+		writeError(resp, Error{
+			Status:  http.StatusBadRequest,
+			Code:    CodeOutsideSession,
+			Message: "Message failed to send because more than 24 hours have passed since the customer last replied to this number.",
+		})
+		return
+	}
+	limit := maxBodyLength
+	if channelLimit, ok := channelBodyLengths[channel]; ok {
+		limit = channelLimit
+	}
+	if len(body) > limit {
+		writeError(resp, Error{
+			Status:  http.StatusBadRequest,
+			Code:    CodeBodyTooLong,
+			Message: fmt.Sprintf("The concatenated message body exceeds the %d character limit.", limit),
+		})
+		return
+	}
+
+	msg := Message{
+		SID:                 s.nextSID("SM"),
+		To:                  form.Get("To"),
+		From:                form.Get("From"),
+		Body:                body,
+		ContentSID:          content,
+		ContentVariables:    form.Get("ContentVariables"),
+		MessagingServiceSID: form.Get("MessagingServiceSid"),
+		MediaURLs:           media,
+		StatusCallback:      form.Get("StatusCallback"),
+		Segments:            (len(body) + segmentLength - 1) / segmentLength,
+		Form:                form,
+	}
+	if msg.Segments == 0 {
+		msg.Segments = 1
+	}
+	s.lock.Lock()
+	s.messages = append(s.messages, msg)
+	s.lock.Unlock()
+
+	writeJSON(resp, http.StatusCreated, map[string]interface{}{
+		"sid":                   msg.SID,
+		"account_sid":           s.AccountSID,
+		"to":                    msg.To,
+		"from":                  msg.From,
+		"body":                  msg.Body,
+		"messaging_service_sid": msg.MessagingServiceSID,
+		"status":                "queued",
+		"num_segments":          fmt.Sprint(msg.Segments),
+		"num_media":             fmt.Sprint(len(msg.MediaURLs)),
+	})
+}
+
+func (s *Server) createCall(resp http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeError(resp, Error{Status: http.StatusBadRequest, Code: 20001, Message: err.Error()})
+		return
+	}
+	if failure, ok := s.nextFailure(); ok {
+		writeError(resp, failure)
+		return
+	}
+	form := req.PostForm
+	if failure, ok := validateNumbers(form); !ok {
+		writeError(resp, failure)
+		return
+	}
+	if form.Get("Twiml") == "" && form.Get("Url") == "" {
+		writeError(resp, Error{Status: http.StatusBadRequest, Code: 21205, Message: "Either Url or Twiml is required."})
+		return
+	}
+
+	call := Call{
+		SID:            s.nextSID("CA"),
+		To:             form.Get("To"),
+		From:           form.Get("From"),
+		TwiML:          form.Get("Twiml"),
+		StatusCallback: form.Get("StatusCallback"),
+		Form:           form,
+	}
+	s.lock.Lock()
+	s.calls = append(s.calls, call)
+	s.lock.Unlock()
+
+	writeJSON(resp, http.StatusCreated, map[string]interface{}{
+		"sid":         call.SID,
+		"account_sid": s.AccountSID,
+		"to":          call.To,
+		"from":        call.From,
+		"status":      "queued",
+	})
+}
+
+// Sign computes the X-Twilio-Signature twilio would send with a webhook to fullURL
+func (s *Server) Sign(fullURL string, form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var payload strings.Builder
+	payload.WriteString(fullURL)
+	for _, key := range keys {
+		for _, val := range form[key] {
+			payload.WriteString(key)
+			payload.WriteString(val)
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(s.AuthToken))
+	mac.Write([]byte(payload.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// PostWebhook sends a signed webhook to fullURL the way twilio does and returns the response. An
+// inbound WhatsApp message opens the sender's session.
+func (s *Server) PostWebhook(fullURL string, form url.Values) (*http.Response, error) {
+	if channel, _ := splitAddress(form.Get("From")); channel == "whatsapp" && form.Get("MessageStatus") == "" {
+		s.OpenSession(form.Get("From"))
+	}
+	req, err := http.NewRequest("POST", fullURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", s.Sign(fullURL, form))
+	return s.client.Do(req)
+}
+
+// FireStatusCallback reports a new status for a previously created message or call to the
+// StatusCallback it was created with
+func (s *Server) FireStatusCallback(sid, status string) (*http.Response, error) {
+	return s.fireStatusCallback(sid, status, url.Values{})
+}
+
+// FailDelivery reports that a previously created message could not be delivered, the way twilio
+// reports carrier errors such as CodeCarrierFiltered
+func (s *Server) FailDelivery(sid string, code int) (*http.Response, error) {
+	return s.fireStatusCallback(sid, "undelivered", url.Values{"ErrorCode": {strconv.Itoa(code)}})
+}
+
+// fireStatusCallback posts form to the StatusCallback of a message or call along with the new
+// status
+func (s *Server) fireStatusCallback(sid, status string, form url.Values) (*http.Response, error) {
+	form.Set("AccountSid", s.AccountSID)
+	var callback string
+	s.lock.Lock()
+	for _, msg := range s.messages {
+		if msg.SID == sid {
+			callback = msg.StatusCallback
+			form.Set("MessageSid", sid)
+			form.Set("MessageStatus", status)
+			form.Set("To", msg.To)
+			form.Set("From", msg.From)
+		}
+	}
+	for _, call := range s.calls {
+		if call.SID == sid {
+			callback = call.StatusCallback
+			form.Set("CallSid", sid)
+			form.Set("CallStatus", status)
+			form.Set("To", call.To)
+			form.Set("From", call.From)
+		}
+	}
+	s.lock.Unlock()
+
+	if callback == "" {
+		return nil, fmt.Errorf("%s does not exist or has no status callback", sid)
+	}
+	return s.PostWebhook(callback, form)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// e164Pattern matches phone numbers in E.164 format, e.g. +15555550100
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+// ConfigErrors is every problem found while validating a DanDemandConfig
+type ConfigErrors []string
+
+func (ce ConfigErrors) Error() string {
+	return fmt.Sprintf("invalid configuration (%d problems):\n  - %s", len(ce), strings.Join(ce, "\n  - "))
+}
+
+// configValidator accumulates problems so they can all be reported at once
+type configValidator struct {
+	problems ConfigErrors
+}
+
+func (cv *configValidator) addf(field, format string, args ...interface{}) {
+	cv.problems = append(cv.problems, field+": "+fmt.Sprintf(format, args...))
+}
+
+func (cv *configValidator) required(field, value string) bool {
+	if value == "" {
+		cv.addf(field, "is required")
+		return false
+	}
+	return true
+}
+
+func (cv *configValidator) duration(field, value string, required bool) {
+	if value == "" {
+		if required {
+			cv.addf(field, "is required, e.g. \"30s\" or \"5m\"")
+		}
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		cv.addf(field, "%q is not a valid duration, use a number with a unit such as \"30s\" or \"5m\"", value)
+	} else if d <= 0 {
+		cv.addf(field, "must be positive, got %q", value)
+	}
+}
+
+func (cv *configValidator) phone(field, value string) {
+	if !cv.required(field, value) {
+		return
+	}
+	if !e164Pattern.MatchString(value) {
+		cv.addf(field, "%q is not an E.164 phone number, use a leading + and country code such as \"+15555550100\"", value)
+	}
+}
+
+func (cv *configValidator) email(field, value string) {
+	if !cv.required(field, value) {
+		return
+	}
+	if _, err := mail.ParseAddress(value); err != nil {
+		cv.addf(field, "%q is not an email address such as \"dan@example.com\"", value)
+	}
+}
+
+func (cv *configValidator) listenAddress(field, value string) {
+	if !cv.required(field, value) {
+		return
+	}
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		cv.addf(field, "%q is not a valid listen address, use host:port such as \"127.0.0.1:8080\"", value)
+	}
+}
+
+func (cv *configValidator) httpURL(field, value, example string) {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		cv.addf(field, "%q must be an absolute http(s) URL such as %q", value, example)
+	}
+}
+
+func (cv *configValidator) token(field, value, prefix, hint string) {
+	if !cv.required(field, value) {
+		return
+	}
+	if !strings.HasPrefix(value, prefix) {
+		cv.addf(field, "must start with %q, %s", prefix, hint)
+	}
+}
+
+// Validate checks the whole configuration and returns a ConfigErrors describing every problem, or
+// nil if the configuration is usable.
+func (ddc *DanDemandConfig) Validate() error {
+	cv := &configValidator{}
+
+	cv.listenAddress("server.address", ddc.Server.Address)
+	cv.listenAddress("server.zpages_address", ddc.Server.ZPagesAddress)
+	if ddc.Server.PublicURL != "" {
+		cv.httpURL("server.public_url", ddc.Server.PublicURL, "https://dan-demand.example.com")
+	}
+
+	if ddc.Server.AdminToken != "" && len(ddc.Server.AdminToken) < minAdminTokenLength {
+		cv.addf("server.admin_token", "must be at least %d characters long", minAdminTokenLength)
+	}
+
+	cv.token("slack.bot_token", ddc.Slack.BotToken, "xoxb-", "copy the Bot User OAuth Access Token from the app's OAuth page")
+	if strings.HasPrefix(ddc.Slack.AppToken, "xapp-") {
+		cv.addf("slack.app_token", "app-level xapp- tokens cannot call the web API, use the OAuth Access Token (xoxp-) instead")
+	} else {
+		cv.token("slack.app_token", ddc.Slack.AppToken, "xoxp-", "copy the OAuth Access Token from the app's OAuth page")
+	}
+	cv.required("slack.verification_token", ddc.Slack.VerificationToken)
+	cv.duration("slack.refresh_interval", ddc.Slack.RefreshInterval, true)
+	if cv.required("slack.api_url", ddc.Slack.APIURL) {
+		cv.httpURL("slack.api_url", ddc.Slack.APIURL, defaultSlackAPIURL)
+	}
+	if ddc.Slack.HandlerMode != handlerModeSequential && ddc.Slack.HandlerMode != handlerModeConcurrent {
+		cv.addf("slack.handler_mode", "%q is not one of %q or %q", ddc.Slack.HandlerMode, handlerModeSequential, handlerModeConcurrent)
+	}
+	if err := validateUserFormat(ddc.Slack.UserFormat); err != nil {
+		cv.addf("slack.user_format", "%v", err)
+	}
+	if strings.Contains(ddc.Slack.ReactionEmoji, ":") {
+		cv.addf("slack.reaction_emoji", "%q should be the bare emoji name without colons", ddc.Slack.ReactionEmoji)
+	}
+
+	if cv.required("twilio.account_sid", ddc.Twilio.SID) && !strings.HasPrefix(ddc.Twilio.SID, "AC") {
+		cv.addf("twilio.account_sid", "must start with \"AC\", copy the Account SID from the twilio console")
+	}
+	cv.required("twilio.token", ddc.Twilio.Token)
+	to := parseTwilioAddress(ddc.Twilio.ToNumber)
+	cv.phone("twilio.to_number", to.Number)
+	switch to.Channel {
+	case channelWhatsApp:
+		if ddc.Twilio.WhatsAppFrom == "" && ddc.Twilio.MessagingServiceSID == "" {
+			cv.addf("twilio.whatsapp_from", "is required to send to a whatsapp: number unless messaging_service_sid is set")
+		}
+	case channelRCS:
+		if ddc.Twilio.RCSFrom == "" && ddc.Twilio.MessagingServiceSID == "" {
+			cv.addf("twilio.rcs_from", "is required to send to an rcs: number unless messaging_service_sid is set")
+		}
+	}
+	if ddc.Twilio.WhatsAppFrom != "" {
+		cv.phone("twilio.whatsapp_from", ddc.Twilio.WhatsAppFrom)
+	}
+	if sid := ddc.Twilio.WhatsAppTemplateSID; sid != "" && !strings.HasPrefix(sid, "HX") {
+		cv.addf("twilio.whatsapp_template_sid", "must start with \"HX\", copy the content template SID from the twilio console")
+	}
+	switch {
+	case ddc.Twilio.FromNumber != "":
+		cv.phone("twilio.from_number", ddc.Twilio.FromNumber)
+	case len(ddc.Twilio.FromNumbers) > 0:
+	case ddc.Twilio.MessagingServiceSID == "":
+		cv.addf("twilio.from_number", "is required unless from_numbers or messaging_service_sid is set")
+	case ddc.Server.PublicURL != "" && ddc.Escalation.After != "":
+		// public_url alone only enables SMS acknowledgements, escalation.after is what places calls.
+		// The keyword is on by default and is ignored without a number to call from.
+		cv.addf("twilio.from_number", "is required to call the Dan after escalation.after, messaging services can only send SMS. Clear escalation.after to only text")
+	}
+	for _, number := range ddc.Twilio.FromNumbers {
+		cv.phone("twilio.from_numbers", number)
+	}
+	if ddc.Twilio.MessagingServiceSID != "" {
+		if len(ddc.Twilio.FromNumbers) > 0 {
+			cv.addf("twilio.messaging_service_sid", "cannot be combined with from_numbers, add the numbers to the messaging service instead")
+		}
+		if !strings.HasPrefix(ddc.Twilio.MessagingServiceSID, "MG") {
+			cv.addf("twilio.messaging_service_sid", "must start with \"MG\", copy the service SID from the twilio console")
+		}
+	}
+	cv.duration("twilio.rate_limit", ddc.Twilio.Limit, true)
+	if cv.required("twilio.base_url", ddc.Twilio.BaseURL) {
+		cv.httpURL("twilio.base_url", ddc.Twilio.BaseURL, defaultTwilioBaseURL)
+	}
+
+	if ddc.Demand.ThreadContext {
+		if ddc.Demand.ThreadReplies < 0 {
+			cv.addf("demand.thread_replies", "must not be negative")
+		}
+		if ddc.Demand.ThreadSegments < 1 {
+			cv.addf("demand.thread_segments", "must be at least 1")
+		}
+	}
+	cv.duration("demand.edit_window", ddc.Demand.EditWindow, true)
+	cv.duration("demand.remind_after", ddc.Demand.RemindAfter, false)
+
+	if ddc.Escalation.After != "" && ddc.Server.PublicURL == "" {
+		cv.addf("escalation.after", "requires server.public_url so twilio can report call results")
+	}
+	cv.duration("escalation.after", ddc.Escalation.After, false)
+
+	if ddc.Email.SMTPAddress != "" {
+		if _, _, err := net.SplitHostPort(ddc.Email.SMTPAddress); err != nil {
+			cv.addf("email.smtp_address", "%q is not a valid address, use host:port such as \"smtp.example.com:587\"", ddc.Email.SMTPAddress)
+		}
+		cv.email("email.from", ddc.Email.From)
+		cv.email("email.to", ddc.Email.To)
+		if ddc.Email.Username != "" {
+			cv.required("email.password", ddc.Email.Password)
+		}
+		if ddc.Email.AfterChunks < 0 {
+			cv.addf("email.after_chunks", "must not be negative")
+		}
+	}
+
+	if ddc.Logging.Format != logFormatLogfmt && ddc.Logging.Format != logFormatJSON {
+		cv.addf("logging.format", "%q is not one of %q or %q", ddc.Logging.Format, logFormatLogfmt, logFormatJSON)
+	}
+	if _, err := logrus.ParseLevel(ddc.Logging.Level); err != nil {
+		cv.addf("logging.level", "%q is not one of debug, info, warning or error", ddc.Logging.Level)
+	}
+
+	if ddc.Capture.File != "" {
+		if ddc.Capture.MaxSizeMB < 1 {
+			cv.addf("capture.max_size_mb", "must be at least 1")
+		}
+		if ddc.Capture.Backups < 0 {
+			cv.addf("capture.backups", "must not be negative")
+		}
+	}
+
+	switch ddc.Tracing.Exporter {
+	case traceExporterZPages:
+	case traceExporterJaeger, traceExporterOCAgent:
+		cv.required("tracing.endpoint", ddc.Tracing.Endpoint)
+	case traceExporterFile:
+		cv.required("tracing.file", ddc.Tracing.File)
+	default:
+		cv.addf("tracing.exporter", "%q is not one of zpages, jaeger, ocagent or file", ddc.Tracing.Exporter)
+	}
+	if ddc.Tracing.SampleFraction < 0 || ddc.Tracing.SampleFraction > 1 {
+		cv.addf("tracing.sample_fraction", "must be between 0 and 1, got %v", ddc.Tracing.SampleFraction)
+	}
+
+	if len(cv.problems) > 0 {
+		return cv.problems
+	}
+	return nil
+}
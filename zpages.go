@@ -5,14 +5,13 @@ import (
 	"net/http/pprof"
 
 	"contrib.go.opencensus.io/exporter/prometheus"
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/zpages"
 )
 
-func startZPages(addr string) error {
+func startZPages(addr string, engine *Engine) error {
 	prom, err := prometheus.NewExporter(prometheus.Options{})
 	if err != nil {
 		errors.Wrap(err, "failed to create prometheus exporter")
@@ -29,13 +28,24 @@ func startZPages(addr string) error {
 		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 		zpages.Handle(mux, "/debug")
-		glog.Infof("starting zpages on http://%s", addr)
-		glog.Fatal(http.ListenAndServe(addr, mux))
+		mux.HandleFunc("/admin/", engine.requireAdmin(engine.HandleAdminConsole))
+		mux.HandleFunc("/admin/api/status", engine.requireAdmin(engine.HandleAdminStatus))
+		mux.HandleFunc("/admin/api/demands/retry", engine.requireAdmin(engine.HandleAdminRetry))
+		mux.HandleFunc("/admin/api/demands/discard", engine.requireAdmin(engine.HandleAdminDiscard))
+		mux.HandleFunc("/admin/api/test-sms", engine.requireAdmin(engine.HandleAdminTestSMS))
+		mux.HandleFunc("/admin/open", engine.requireAdmin(engine.HandleOpenDemands))
+		mux.HandleFunc("/healthz", engine.HandleHealthz)
+		mux.HandleFunc("/readyz", engine.HandleReadyz)
+		logger.WithField("address", addr).Info("starting zpages")
+		logger.WithError(http.ListenAndServe(addr, mux)).Fatal("zpages server failed")
 	}()
 
 	view.RegisterExporter(prom)
 	if err := view.Register(ochttp.DefaultServerViews...); err != nil {
 		return errors.Wrap(err, "failed to register ochttp views: ")
 	}
+	if err := view.Register(appViews...); err != nil {
+		return errors.Wrap(err, "failed to register dan-demand views: ")
+	}
 	return nil
 }